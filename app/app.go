@@ -2,14 +2,22 @@ package app
 
 import (
 	"errors"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dnstapir/mqtt-bridge/app/downbridge"
 	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+	"github.com/dnstapir/mqtt-bridge/app/topics"
 	"github.com/dnstapir/mqtt-bridge/app/upbridge"
 	"github.com/dnstapir/mqtt-bridge/shared"
 )
 
+const cWATCH_INTERVAL = 10 * time.Second
+
 type App struct {
 	Log     shared.LoggerIF
 	Mqtt    shared.MqttIF
@@ -20,17 +28,65 @@ type App struct {
 	isInitialized bool
 	doneChan      chan error
 	stopChan      chan bool
+	reloadChan    chan reloadReq
+	loopDone      chan struct{}
 	wg            *sync.WaitGroup
+	running       []runningBridge
+	watchInterval time.Duration
+}
+
+type bridgeIF interface {
+	Reload() error
+	Stop()
+}
+
+type runningBridge struct {
+	conf     Bridge
+	bridge   bridgeIF
+	done     chan struct{}
+	cancel   chan struct{} // Closed when stopping, ends publishing retries
+	cleanups []func()
+}
+
+type reloadReq struct {
+	bridges []Bridge
+	errCh   chan error
 }
 
 type Bridge struct {
-	Direction   string `toml:"Direction"`
-	MqttTopic   string `toml:"MqttTopic"`
-	MqttRetain  bool   `toml:"MqttRetain"`
-	NatsSubject string `toml:"NatsSubject"`
-	NatsQueue   string `toml:"NatsQueue"`
-	Key         string `toml:"Key"`
-	Schema      string `toml:"Schema"`
+	Direction         string   `toml:"Direction"`
+	MqttTopic         string   `toml:"MqttTopic"`
+	MqttRetain        bool     `toml:"MqttRetain"`
+	MqttQos           byte     `toml:"MqttQos"`
+	NatsSubject       string   `toml:"NatsSubject"`
+	NatsQueue         string   `toml:"NatsQueue"`
+	NatsJetStream     bool     `toml:"NatsJetStream"`
+	NatsStream        string   `toml:"NatsStream"`
+	NatsConsumer      string   `toml:"NatsConsumer"`
+	Key               string   `toml:"Key"`
+	Schema            string   `toml:"Schema"`
+	DeadLetterSubject string   `toml:"DeadLetterSubject"`
+	QueueSize         int      `toml:"QueueSize"`
+	QueueOverflow     string   `toml:"QueueOverflow"`
+	Workers           int      `toml:"Workers"`
+	KeyCacheSize      int      `toml:"KeyCacheSize"`
+	KeyCacheTtl       int      `toml:"KeyCacheTtl"`
+	KeyNegativeTtl    int      `toml:"KeyNegativeTtl"`
+	RevocationSubject string   `toml:"RevocationSubject"`
+	AllowedAlgorithms []string `toml:"AllowedAlgorithms"`
+	SignaturePolicy   string   `toml:"SignaturePolicy"`
+	MaxSignatures     int      `toml:"MaxSignatures"`
+	RetireKeyId       string   `toml:"RetireKeyId"`
+	RetireKeyAt       string   `toml:"RetireKeyAt"`
+	SignClaims        bool     `toml:"SignClaims"`
+	SignClaimsTtl     int      `toml:"SignClaimsTtl"`
+	MaxMessageAge     int      `toml:"MaxMessageAge"`
+	ClockSkew         int      `toml:"ClockSkew"`
+	ReplayWindow      int      `toml:"ReplayWindow"`
+	DedupWindow       int      `toml:"DedupWindow"`
+	DedupSize         int      `toml:"DedupSize"`
+	DedupField        string   `toml:"DedupField"`
+	WatchFiles        bool     `toml:"WatchFiles"`
 }
 
 func (a *App) Initialize() error {
@@ -39,6 +95,9 @@ func (a *App) Initialize() error {
 
 	a.doneChan = make(chan error, 10)
 	a.stopChan = make(chan bool, 1)
+	a.reloadChan = make(chan reloadReq)
+	a.loopDone = make(chan struct{})
+	a.watchInterval = cWATCH_INTERVAL
 
 	if a.Log == nil {
 		return errors.New("no logger object")
@@ -56,11 +115,12 @@ func (a *App) Initialize() error {
 		return errors.New("no nodeman object")
 	}
 
-	if len(a.Bridges) == 0 {
-		return errors.New("no bridge configuration")
+	err := validateBridges(a.Bridges)
+	if err != nil {
+		return err
 	}
 
-	err := keys.SetLogger(a.Log)
+	err = keys.SetLogger(a.Log)
 	if err != nil {
 		return err
 	}
@@ -69,6 +129,116 @@ func (a *App) Initialize() error {
 	return nil
 }
 
+func validateBridges(bridges []Bridge) error {
+	if len(bridges) == 0 {
+		return errors.New("no bridge configuration")
+	}
+
+	for _, bridge := range bridges {
+		if bridge.Direction != "up" && bridge.Direction != "down" {
+			return errors.New("unsupported bridge direction")
+		}
+
+		if bridge.MqttQos > 2 {
+			return errors.New("mqtt qos must be 0, 1 or 2")
+		}
+
+		if !bridge.queueConf().IsValid() {
+			return errors.New("invalid queue size or overflow policy")
+		}
+
+		if bridge.Direction == "down" && strings.Contains(bridge.MqttTopic, "{kid}") {
+			return errors.New("key id binding only supported for up bridges")
+		}
+
+		err := bridge.checkTemplates()
+		if err != nil {
+			return err
+		}
+
+		if bridge.Direction == "down" && bridge.NatsJetStream {
+			return errors.New("jetstream publishing only supported for up bridges")
+		}
+
+		if (bridge.NatsStream == "") != (bridge.NatsConsumer == "") {
+			return errors.New("durable consumer needs both stream and consumer name")
+		}
+
+		if bridge.Direction == "up" && bridge.NatsConsumer != "" {
+			return errors.New("durable consumers only supported for down bridges")
+		}
+
+		if bridge.KeyCacheSize < 0 || bridge.KeyCacheTtl < 0 || bridge.KeyNegativeTtl < 0 {
+			return errors.New("bad key cache size or ttl")
+		}
+
+		if bridge.Direction == "down" && bridge.RevocationSubject != "" {
+			return errors.New("key revocation only supported for up bridges")
+		}
+
+		_, err = keys.ParseAlgorithms(bridge.AllowedAlgorithms)
+		if err != nil {
+			return err
+		}
+
+		if bridge.Direction == "down" && bridge.SignaturePolicy != "" {
+			return errors.New("signature policy only supported for up bridges")
+		}
+
+		_, err = upbridge.ParsePolicy(bridge.SignaturePolicy)
+		if err != nil {
+			return err
+		}
+
+		if bridge.Direction == "down" && bridge.MaxSignatures != 0 {
+			return errors.New("maximum number of signatures only supported for up bridges")
+		}
+
+		if bridge.MaxSignatures < 0 {
+			return errors.New("bad maximum number of signatures")
+		}
+
+		if bridge.Direction == "up" && bridge.RetireKeyId != "" {
+			return errors.New("key retirement only supported for down bridges")
+		}
+
+		_, err = bridge.retireKeyAt()
+		if err != nil {
+			return err
+		}
+
+		if bridge.Direction == "up" && (bridge.SignClaims || bridge.SignClaimsTtl != 0) {
+			return errors.New("signing claims only supported for down bridges")
+		}
+
+		if bridge.SignClaimsTtl < 0 || (bridge.SignClaimsTtl > 0 && !bridge.SignClaims) {
+			return errors.New("bad signed claims ttl")
+		}
+
+		if bridge.Direction == "down" && (bridge.MaxMessageAge != 0 || bridge.ClockSkew != 0 || bridge.ReplayWindow != 0) {
+			return errors.New("replay protection only supported for up bridges")
+		}
+
+		if bridge.MaxMessageAge < 0 || bridge.ClockSkew < 0 || bridge.ReplayWindow < 0 {
+			return errors.New("bad replay protection settings")
+		}
+
+		if bridge.Direction == "down" && (bridge.DedupWindow != 0 || bridge.DedupSize != 0 || bridge.DedupField != "") {
+			return errors.New("duplicate suppression only supported for up bridges")
+		}
+
+		if bridge.DedupWindow < 0 || bridge.DedupSize < 0 {
+			return errors.New("bad dedup window or size")
+		}
+
+		if bridge.DedupField != "" && bridge.DedupWindow == 0 && bridge.DedupSize == 0 {
+			return errors.New("dedup field needs a window or size")
+		}
+	}
+
+	return nil
+}
+
 func (a *App) Run() <-chan error {
 	if !a.isInitialized {
 		panic("app not initialized")
@@ -78,6 +248,7 @@ func (a *App) Run() <-chan error {
 	a.wg.Add(1)
 	go func() {
 		defer a.wg.Done()
+		defer close(a.loopDone)
 
 		err := a.Nats.Connect()
 		if err != nil {
@@ -98,6 +269,8 @@ func (a *App) Run() <-chan error {
 			case <-a.stopChan:
 				a.Log.Info("Stopping main worker thread")
 				return
+			case req := <-a.reloadChan:
+				req.errCh <- a.reloadBridges(req.bridges)
 			}
 		}
 	}()
@@ -124,55 +297,398 @@ func (a *App) Stop() error {
 	return nil
 }
 
+/*
+ * Reload the bridge configuration. Bridges not in the new list are stopped and
+ * new ones started, a changed bridge is restarted. Bridges that did not change
+ * keep running and only load their keys and schemas again, keeping the old
+ * ones if the new ones can not be loaded.
+ */
+func (a *App) Reload(bridges []Bridge) error {
+	if !a.isInitialized {
+		return errors.New("app not initialized")
+	}
+
+	err := validateBridges(bridges)
+	if err != nil {
+		return err
+	}
+
+	req := reloadReq{
+		bridges: bridges,
+		errCh:   make(chan error, 1),
+	}
+	select {
+	case a.reloadChan <- req:
+	case <-a.loopDone:
+		return errors.New("app not running")
+	}
+
+	return <-req.errCh
+}
+
+func (a *App) reloadBridges(bridges []Bridge) error {
+	var errs []error
+
+	/* Match each configured bridge against one identical running bridge */
+	remaining := a.running
+	kept := make([]runningBridge, 0, len(bridges))
+	var added []Bridge
+	for _, bridge := range bridges {
+		idx := slices.IndexFunc(remaining, func(r runningBridge) bool {
+			return reflect.DeepEqual(r.conf, bridge)
+		})
+		if idx < 0 {
+			added = append(added, bridge)
+			continue
+		}
+		kept = append(kept, remaining[idx])
+		remaining = slices.Delete(slices.Clone(remaining), idx, idx+1)
+	}
+
+	/* Stop first, a changed bridge may reuse e.g. its durable consumer */
+	for _, r := range remaining {
+		a.Log.Info("Stopping %s bridge for '%s'", r.conf.Direction, r.conf.MqttTopic)
+		a.stopBridge(r)
+	}
+
+	for _, r := range kept {
+		err := r.bridge.Reload()
+		if err != nil {
+			a.Log.Error("Error reloading %s bridge for '%s', keeping old configuration, err: '%s'", r.conf.Direction, r.conf.MqttTopic, err)
+			errs = append(errs, err)
+		}
+	}
+
+	for _, bridge := range added {
+		a.Log.Info("Starting %s bridge for '%s'", bridge.Direction, bridge.MqttTopic)
+		r, err := a.startBridge(bridge)
+		if err != nil {
+			a.Log.Error("Error starting %s bridge for '%s', err: '%s'", bridge.Direction, bridge.MqttTopic, err)
+			errs = append(errs, err)
+			continue
+		}
+		kept = append(kept, r)
+	}
+
+	a.running = kept
+	a.Bridges = bridges
+
+	return errors.Join(errs...)
+}
+
 func (a *App) startBridges() {
 	for _, bridge := range a.Bridges {
-		if bridge.Direction == "up" {
-			conf := upbridge.Conf{
-				Log:     a.Log,
-				Nodeman: a.Nodeman,
-				Key:     bridge.Key,
-				Schema:  bridge.Schema,
-			}
-			ub, err := upbridge.Create(conf)
-			if err != nil {
-				panic(err)
-			}
+		r, err := a.startBridge(bridge)
+		if err != nil {
+			panic(err)
+		}
+		a.running = append(a.running, r)
+	}
+}
 
-			inCh, err := a.Mqtt.Subscribe(bridge.MqttTopic)
-			if err != nil {
-				panic(err)
-			}
+/* On error, everything set up so far is released again */
+func (a *App) startBridge(bridge Bridge) (r runningBridge, err error) {
+	r.conf = bridge
+	r.done = make(chan struct{})
+	r.cancel = make(chan struct{})
+	defer func() {
+		if err != nil {
+			r.cleanUp()
+		}
+	}()
 
-			outCh, err := a.Nats.StartPublishing(bridge.NatsSubject, bridge.NatsQueue)
-			if err != nil {
-				panic(err)
-			}
+	if bridge.Direction == "up" {
+		topic, err := topics.ParsePattern(bridge.MqttTopic)
+		if err != nil {
+			return r, err
+		}
 
-			go ub.Start(inCh, outCh)
-		} else if bridge.Direction == "down" {
-			conf := downbridge.Conf{
-				Log:    a.Log,
-				Key:    bridge.Key,
-				Schema: bridge.Schema,
-			}
-			db, err := downbridge.Create(conf)
-			if err != nil {
-				panic(err)
-			}
+		subject, err := templates.ForNatsSubject(bridge.NatsSubject)
+		if err != nil {
+			return r, err
+		}
 
-			inCh, err := a.Nats.Subscribe(bridge.NatsSubject, bridge.NatsQueue)
-			if err != nil {
-				panic(err)
+		deadCh, err := a.startDeadLetters(bridge, &r)
+		if err != nil {
+			return r, err
+		}
+
+		revokeCh, err := a.startRevocations(bridge, &r)
+		if err != nil {
+			return r, err
+		}
+
+		conf := upbridge.Conf{
+			Log:          a.Log,
+			Nodeman:      a.Nodeman,
+			Topic:        topic,
+			Subject:      subject,
+			DeadLetterCh: deadCh,
+			RevocationCh: revokeCh,
+			Workers:      bridge.Workers,
+			CacheSize:    bridge.KeyCacheSize,
+			CacheTTL:     time.Duration(bridge.KeyCacheTtl) * time.Second,
+			NegativeTTL:  time.Duration(bridge.KeyNegativeTtl) * time.Second,
+			Algorithms:   bridge.AllowedAlgorithms,
+			Policy:       bridge.SignaturePolicy,
+			MaxSigs:      bridge.MaxSignatures,
+			Key:          bridge.Key,
+			Schema:       bridge.Schema,
+			MaxAge:       time.Duration(bridge.MaxMessageAge) * time.Second,
+			ClockSkew:    time.Duration(bridge.ClockSkew) * time.Second,
+			ReplayWindow: bridge.ReplayWindow,
+			DedupWindow:  time.Duration(bridge.DedupWindow) * time.Second,
+			DedupSize:    bridge.DedupSize,
+			DedupField:   bridge.DedupField,
+		}
+		ub, err := upbridge.Create(conf)
+		if err != nil {
+			return r, err
+		}
+
+		inCh, err := a.Mqtt.Subscribe(topic.Filter(), bridge.MqttQos, bridge.queueConf())
+		if err != nil {
+			return r, err
+		}
+		r.addCleanup(func() { a.unsubscribeMqtt(inCh) })
+
+		var outCh chan<- shared.NatsData
+		if bridge.NatsJetStream {
+			outCh, err = a.Nats.StartJetStreamPublishing(bridge.NatsSubject, r.cancel)
+		} else {
+			outCh, err = a.Nats.StartPublishing(bridge.NatsSubject, bridge.NatsQueue)
+		}
+		if err != nil {
+			return r, err
+		}
+		r.addCleanup(func() { close(outCh) })
+
+		r.bridge = ub
+		go func() {
+			defer close(r.done)
+			ub.Start(inCh, outCh)
+		}()
+	} else if bridge.Direction == "down" {
+		topic, err := templates.ForMqttTopic(bridge.MqttTopic)
+		if err != nil {
+			return r, err
+		}
+
+		retireAt, err := bridge.retireKeyAt()
+		if err != nil {
+			return r, err
+		}
+
+		deadCh, err := a.startDeadLetters(bridge, &r)
+		if err != nil {
+			return r, err
+		}
+
+		conf := downbridge.Conf{
+			Log:          a.Log,
+			Topic:        topic,
+			DeadLetterCh: deadCh,
+			Algorithms:   bridge.AllowedAlgorithms,
+			RetireKeyID:  bridge.RetireKeyId,
+			RetireKeyAt:  retireAt,
+			Key:          bridge.Key,
+			Schema:       bridge.Schema,
+			Claims:       bridge.SignClaims,
+			ClaimsTTL:    time.Duration(bridge.SignClaimsTtl) * time.Second,
+		}
+		db, err := downbridge.Create(conf)
+		if err != nil {
+			return r, err
+		}
+
+		var inCh <-chan shared.NatsData
+		if bridge.NatsConsumer != "" {
+			inCh, err = a.Nats.SubscribeDurable(bridge.NatsStream, bridge.NatsConsumer, bridge.NatsSubject, bridge.queueConf())
+		} else {
+			inCh, err = a.Nats.Subscribe(bridge.NatsSubject, bridge.NatsQueue, bridge.queueConf())
+		}
+		if err != nil {
+			return r, err
+		}
+		r.addCleanup(func() { a.unsubscribeNats(inCh) })
+
+		outCh, err := a.Mqtt.StartPublishing(bridge.MqttTopic, bridge.MqttRetain, bridge.MqttQos)
+		if err != nil {
+			return r, err
+		}
+		r.addCleanup(func() { close(outCh) })
+
+		r.bridge = db
+		go func() {
+			defer close(r.done)
+			db.Start(inCh, outCh)
+		}()
+	} else {
+		return r, errors.New("unsupported bridge direction")
+	}
+
+	if bridge.WatchFiles {
+		go a.watchFiles(r)
+	}
+
+	return r, nil
+}
+
+/*
+ * Reload a bridge like on SIGHUP when its key or schema file changes, until
+ * the bridge has stopped
+ */
+func (a *App) watchFiles(r runningBridge) {
+	paths := make([]string, 0, 2)
+	for _, path := range []string{r.conf.Key, r.conf.Schema} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	ver, err := filesVersion(paths)
+	if err != nil {
+		a.Log.Warning("Could not check files of %s bridge for '%s', err: '%s'", r.conf.Direction, r.conf.MqttTopic, err)
+	}
+
+	ticker := time.NewTicker(a.watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			newVer, err := filesVersion(paths)
+			if err != nil || newVer == ver {
+				continue
 			}
+			ver = newVer
 
-			outCh, err := a.Mqtt.StartPublishing(bridge.MqttTopic, bridge.MqttRetain)
+			a.Log.Info("Files of %s bridge for '%s' changed, reloading", r.conf.Direction, r.conf.MqttTopic)
+			err = r.bridge.Reload()
 			if err != nil {
-				panic(err)
+				a.Log.Warning("Error reloading %s bridge for '%s', keeping old configuration, err: '%s'", r.conf.Direction, r.conf.MqttTopic, err)
 			}
+		}
+	}
+}
 
-			go db.Start(inCh, outCh)
-		} else {
-			panic("unsupported bridge direction")
+func filesVersion(paths []string) (string, error) {
+	versions := make([]string, 0, len(paths))
+	for _, path := range paths {
+		ver, err := keys.KeySourceVersion(path)
+		if err != nil {
+			return "", err
+		}
+		versions = append(versions, ver)
+	}
+
+	return strings.Join(versions, ";"), nil
+}
+
+/*
+ * Once the bridge has returned nothing is published anymore, so its
+ * subscriptions and publishers can be released. Messages that can not be
+ * published, e.g. while JetStream is unavailable, are dropped.
+ */
+func (a *App) stopBridge(r runningBridge) {
+	r.bridge.Stop()
+	close(r.cancel)
+	<-r.done
+	r.cleanUp()
+}
+
+func (a *App) unsubscribeMqtt(ch <-chan shared.MqttData) {
+	err := a.Mqtt.Unsubscribe(ch)
+	if err != nil {
+		a.Log.Warning("Error unsubscribing from mqtt: '%s'", err)
+	}
+}
+
+func (a *App) unsubscribeNats(ch <-chan shared.NatsData) {
+	err := a.Nats.Unsubscribe(ch)
+	if err != nil {
+		a.Log.Warning("Error unsubscribing from nats: '%s'", err)
+	}
+}
+
+func (r *runningBridge) addCleanup(f func()) {
+	r.cleanups = append(r.cleanups, f)
+}
+
+/* In reverse order of setting up */
+func (r *runningBridge) cleanUp() {
+	for _, f := range slices.Backward(r.cleanups) {
+		f()
+	}
+	r.cleanups = nil
+}
+
+func (a *App) startDeadLetters(bridge Bridge, r *runningBridge) (chan<- shared.NatsData, error) {
+	if bridge.DeadLetterSubject == "" {
+		return nil, nil
+	}
+
+	deadCh, err := a.Nats.StartPublishing(bridge.DeadLetterSubject, "")
+	if err != nil {
+		return nil, err
+	}
+	r.addCleanup(func() { close(deadCh) })
+
+	return deadCh, nil
+}
+
+/* No queue group, every instance must drop revoked keys */
+func (a *App) startRevocations(bridge Bridge, r *runningBridge) (<-chan shared.NatsData, error) {
+	if bridge.RevocationSubject == "" {
+		return nil, nil
+	}
+
+	revokeCh, err := a.Nats.Subscribe(bridge.RevocationSubject, "", shared.QueueConf{})
+	if err != nil {
+		return nil, err
+	}
+	r.addCleanup(func() { a.unsubscribeNats(revokeCh) })
+
+	return revokeCh, nil
+}
+
+/* Placeholders only have values in the templates of their direction */
+func (b Bridge) checkTemplates() error {
+	if b.Direction == "up" {
+		_, err := topics.ParsePattern(b.MqttTopic)
+		if err != nil {
+			return err
 		}
+		_, err = templates.ForNatsSubject(b.NatsSubject)
+		return err
+	}
+
+	_, err := templates.ForMqttTopic(b.MqttTopic)
+	return err
+}
+
+func (b Bridge) queueConf() shared.QueueConf {
+	return shared.QueueConf{
+		Size:     b.QueueSize,
+		Overflow: shared.OverflowPolicy(b.QueueOverflow),
+	}
+}
+
+func (b Bridge) retireKeyAt() (time.Time, error) {
+	if (b.RetireKeyId == "") != (b.RetireKeyAt == "") {
+		return time.Time{}, errors.New("key retirement needs both key id and time")
+	}
+
+	if b.RetireKeyAt == "" {
+		return time.Time{}, nil
 	}
+
+	retireAt, err := time.Parse(time.RFC3339, b.RetireKeyAt)
+	if err != nil {
+		return time.Time{}, errors.New("key retirement time must be in RFC 3339 format")
+	}
+
+	return retireAt, nil
 }
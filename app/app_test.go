@@ -1,29 +1,24 @@
 package app
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/dnstapir/mqtt-bridge/app/keys"
 	"github.com/dnstapir/mqtt-bridge/inject/fake"
 	"github.com/dnstapir/mqtt-bridge/shared"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAppDownBasic(t *testing.T) {
-	fakeNats := fake.Nats()
-	fakeMqtt := fake.Mqtt()
-
-	application := App{
-		Log:     fake.Logger(),
-		Nats:    fakeNats,
-		Mqtt:    fakeMqtt,
-		Nodeman: fake.Nodeman(),
-		Bridges: make([]Bridge, 0),
-	}
-
-	/* Actual generation of key happens later */
-	workdir := t.TempDir()
-	keyfile := filepath.Join(workdir, "testkey.json")
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	generateTestKey(t, keyfile, "tmp-key-utest-app")
 
 	bridge := Bridge{
 		Direction:   "down",
@@ -33,30 +28,13 @@ func TestAppDownBasic(t *testing.T) {
 		Key:         keyfile,
 		Schema:      "",
 	}
-
-	application.Bridges = append(application.Bridges, bridge)
-
-	err := application.Initialize()
-	if err != nil {
-		t.Fatalf("Error initializing app: %s", err)
-	}
-
-	/*
-	 * Generate the key now that the app is initialized (to ensure logger
-	 * object for "keys" package has been set, else package won't work)
-	 */
-	_, err = keys.GenerateSignKey(keyfile, "tmp-key-utest-app")
-	if err != nil {
-		t.Fatalf("Error generating key: %s", err)
-	}
-
-	application.Run()
+	application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
 
 	in := []byte("{\"foo\": \"bar\"}")
-	fakeNats.Inject(in)
+	fakeNats.Inject(shared.NatsData{Payload: in})
 	out := fakeMqtt.Eavesdrop()
 
-	err = application.Stop()
+	err := application.Stop()
 	if err != nil {
 		t.Fatalf("Error stopping application: %s", err)
 	}
@@ -66,7 +44,11 @@ func TestAppDownBasic(t *testing.T) {
 		t.Fatalf("Error getting validation key: %s", err)
 	}
 
-	checkedIn, err := keys.CheckSignature(out, valkey)
+	if out.Topic != "testtopic" {
+		t.Fatalf("Topic mismatch, want: 'testtopic', got: '%s'", out.Topic)
+	}
+
+	checkedIn, err := keys.CheckSignature(out.Payload, valkey)
 	if err != nil {
 		t.Fatalf("Error checking signature: %s", err)
 	}
@@ -240,3 +222,961 @@ func TestAppUpNoKeyInConfig(t *testing.T) {
 		}
 	}
 }
+
+/* The fakes as seen by the bridge tests */
+type natsTap interface {
+	shared.NatsIF
+	Inject(shared.NatsData)
+	Eavesdrop() shared.NatsData
+}
+
+type mqttTap interface {
+	shared.MqttIF
+	Inject(shared.MqttData)
+	Eavesdrop() shared.MqttData
+}
+
+/* Keys generated before starting are loaded by the bridge right away */
+func generateTestKey(t *testing.T, keyfile, kid string) keys.SignKey {
+	t.Helper()
+
+	err := keys.SetLogger(fake.Logger())
+	if err != nil {
+		t.Fatalf("Error setting key logger: %s", err)
+	}
+
+	signkey, err := keys.GenerateSignKey(keyfile, kid)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	return signkey
+}
+
+func startUpBridge(t *testing.T, bridge Bridge) (*App, natsTap, mqttTap) {
+	t.Helper()
+
+	if bridge.Direction != "up" {
+		t.Fatalf("Not an up bridge")
+	}
+
+	return startTestApp(t, bridge)
+}
+
+func startDownBridge(t *testing.T, bridge Bridge) (*App, natsTap, mqttTap) {
+	t.Helper()
+
+	if bridge.Direction != "down" {
+		t.Fatalf("Not a down bridge")
+	}
+
+	return startTestApp(t, bridge)
+}
+
+func startTestApp(t *testing.T, bridge Bridge) (*App, natsTap, mqttTap) {
+	t.Helper()
+
+	fakeNats := fake.Nats()
+	fakeMqtt := fake.Mqtt()
+
+	application := &App{
+		Log:     fake.Logger(),
+		Nats:    fakeNats,
+		Mqtt:    fakeMqtt,
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{bridge},
+	}
+
+	err := application.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+
+	application.Run()
+
+	return application, fakeNats, fakeMqtt
+}
+
+func signTestData(t *testing.T, in []byte, signkey keys.SignKey) []byte {
+	t.Helper()
+
+	signedIn, err := keys.Sign(in, signkey)
+	if err != nil {
+		t.Fatalf("Error signing data: %s", err)
+	}
+
+	return signedIn
+}
+
+func TestAppUpKeyBoundTopic(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	signkey := generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	application, fakeNats, fakeMqtt := startUpBridge(t, Bridge{
+		Direction:   "up",
+		MqttTopic:   "events/up/{kid}/#",
+		NatsSubject: "testsubject",
+		NatsQueue:   "testqueue",
+		Key:         keyfile,
+	})
+	defer application.Stop()
+
+	in := []byte("{\"foo\": \"bar\"}")
+	fakeMqtt.Inject(shared.MqttData{
+		Payload: signTestData(t, in, signkey),
+		Topic:   "events/up/tmp-key-utest-app/some_event",
+	})
+
+	out := fakeNats.Eavesdrop()
+	if string(in) != string(out.Payload) {
+		t.Fatalf("Data mismatch, want: '%s', got: '%s'", in, out.Payload)
+	}
+
+	if out.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER] != "tmp-key-utest-app" {
+		t.Fatalf("Bad key identifier header '%s'", out.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER])
+	}
+}
+
+func TestAppUpJetStream(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	signkey := generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	application, fakeNats, fakeMqtt := startUpBridge(t, Bridge{
+		Direction:     "up",
+		MqttTopic:     "events/up/{kid}/#",
+		NatsSubject:   "testsubject",
+		NatsJetStream: true,
+		Key:           keyfile,
+	})
+	defer application.Stop()
+
+	in := []byte("{\"foo\": \"bar\"}")
+	signedIn := signTestData(t, in, signkey)
+	fakeMqtt.Inject(shared.MqttData{
+		Payload: signedIn,
+		Topic:   "events/up/tmp-key-utest-app/some_event",
+	})
+
+	out := fakeNats.Eavesdrop()
+	if string(in) != string(out.Payload) {
+		t.Fatalf("Data mismatch, want: '%s', got: '%s'", in, out.Payload)
+	}
+
+	sigHash := sha256.Sum256(signedIn)
+	wantedMsgID := hex.EncodeToString(sigHash[:])
+	if out.MsgID != wantedMsgID {
+		t.Fatalf("Message ID mismatch, want: '%s', got: '%s'", wantedMsgID, out.MsgID)
+	}
+}
+
+func TestAppUpSubjectTemplate(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	signkey := generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	application, fakeNats, fakeMqtt := startUpBridge(t, Bridge{
+		Direction:   "up",
+		MqttTopic:   "events/up/{kid}/#",
+		NatsSubject: "events.up.{topic[3]}.{kid}",
+		NatsQueue:   "testqueue",
+		Key:         keyfile,
+	})
+	defer application.Stop()
+
+	in := []byte("{\"foo\": \"bar\"}")
+	fakeMqtt.Inject(shared.MqttData{
+		Payload: signTestData(t, in, signkey),
+		Topic:   "events/up/tmp-key-utest-app/some_event",
+	})
+
+	out := fakeNats.Eavesdrop()
+	if string(in) != string(out.Payload) {
+		t.Fatalf("Data mismatch, want: '%s', got: '%s'", in, out.Payload)
+	}
+
+	wantedSubject := "events.up.some_event.tmp-key-utest-app"
+	if out.Subject != wantedSubject {
+		t.Fatalf("Subject mismatch, want: '%s', got: '%s'", wantedSubject, out.Subject)
+	}
+}
+
+func TestAppDownKeyBoundTopicRejected(t *testing.T) {
+	application := App{
+		Log:     fake.Logger(),
+		Nats:    fake.Nats(),
+		Mqtt:    fake.Mqtt(),
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:   "down",
+				MqttTopic:   "observations/down/{kid}",
+				NatsSubject: "testsubject",
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err == nil {
+		t.Fatalf("Expected error for key bound down bridge")
+	}
+}
+
+func TestAppDownTopicTemplate(t *testing.T) {
+	var tests = []struct {
+		name     string
+		subject  string
+		headers  map[string]string
+		expected string
+	}{
+		{"FROM_SUBJECT", "observations.down.tapir-pop", map[string]string{}, "observations/down/tapir-pop"},
+		{"ESCAPED", "observations.down.a/b", map[string]string{}, "observations/down/a%2Fb"},
+		{"FROM_HEADER", "observations.down.tapir-pop",
+			map[string]string{shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC: "observations/down/edge1"},
+			"observations/down/edge1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyfile := filepath.Join(t.TempDir(), "testkey.json")
+			generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+			bridge := Bridge{
+				Direction:   "down",
+				MqttTopic:   "observations/down/{subject[2]}",
+				NatsSubject: "observations.down.*",
+				NatsQueue:   "testqueue",
+				Key:         keyfile,
+				Schema:      "",
+			}
+			application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+			in := shared.NatsData{
+				Subject: tt.subject,
+				Headers: tt.headers,
+				Payload: []byte("{\"foo\": \"bar\"}"),
+			}
+			fakeNats.Inject(in)
+			out := fakeMqtt.Eavesdrop()
+
+			err := application.Stop()
+			if err != nil {
+				t.Fatalf("Error stopping application: %s", err)
+			}
+
+			if out.Topic != tt.expected {
+				t.Fatalf("Topic mismatch, want: '%s', got: '%s'", tt.expected, out.Topic)
+			}
+		})
+	}
+}
+
+func TestAppDownDurableAckAfterPublish(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	bridge := Bridge{
+		Direction:    "down",
+		MqttTopic:    "testtopic",
+		NatsSubject:  "testsubject",
+		NatsStream:   "teststream",
+		NatsConsumer: "testconsumer",
+		Key:          keyfile,
+		Schema:       "",
+	}
+	application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+	acker := fake.Acker()
+	fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}"), Acker: acker})
+	if acker.Acked {
+		t.Fatalf("Message acked before being published")
+	}
+
+	fakeMqtt.Eavesdrop()
+
+	err := application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+
+	if !acker.Acked || acker.Naked || acker.Termed {
+		t.Fatalf("Unexpected ack state, acked: %t, naked: %t, termed: %t", acker.Acked, acker.Naked, acker.Termed)
+	}
+}
+
+func TestAppInvalidMqttQos(t *testing.T) {
+	application := App{
+		Log:     fake.Logger(),
+		Nats:    fake.Nats(),
+		Mqtt:    fake.Mqtt(),
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:   "up",
+				MqttTopic:   "events/up/{kid}",
+				MqttQos:     3,
+				NatsSubject: "testsubject",
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err == nil {
+		t.Fatalf("Expected error for invalid qos")
+	}
+}
+
+func TestAppInvalidAllowedAlgorithms(t *testing.T) {
+	application := App{
+		Log:     fake.Logger(),
+		Nats:    fake.Nats(),
+		Mqtt:    fake.Mqtt(),
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:         "up",
+				MqttTopic:         "events/up/{kid}",
+				NatsSubject:       "testsubject",
+				AllowedAlgorithms: []string{"EdDSA", "HS256"},
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err == nil {
+		t.Fatalf("Expected error for symmetric algorithm")
+	}
+}
+
+func TestAppUpSignaturePolicyAll(t *testing.T) {
+	keydir := filepath.Join(t.TempDir(), "keys")
+	err := os.Mkdir(keydir, 0750)
+	if err != nil {
+		t.Fatalf("Error creating key directory: %s", err)
+	}
+
+	/* An edge node co-signing with an aggregator */
+	nodeKey := generateTestKey(t, filepath.Join(keydir, "node-a.json"), "node-a")
+	aggKey := generateTestKey(t, filepath.Join(keydir, "aggregator.json"), "aggregator")
+
+	application, fakeNats, fakeMqtt := startUpBridge(t, Bridge{
+		Direction:       "up",
+		MqttTopic:       "events/up/{kid}",
+		NatsSubject:     "testsubject",
+		Key:             keydir,
+		SignaturePolicy: "all",
+	})
+	defer application.Stop()
+
+	in := []byte("{\"foo\": \"bar\"}")
+	signedIn, err := jws.Sign(in, jws.WithJSON(),
+		jws.WithKey(nodeKey.Algorithm(), nodeKey),
+		jws.WithKey(aggKey.Algorithm(), aggKey))
+	if err != nil {
+		t.Fatalf("Error signing data: %s", err)
+	}
+
+	fakeMqtt.Inject(shared.MqttData{Payload: signedIn, Topic: "events/up/node-a"})
+	out := fakeNats.Eavesdrop()
+
+	if string(out.Payload) != string(in) {
+		t.Fatalf("Data mismatch, want: '%s', got: '%s'", in, out.Payload)
+	}
+
+	if out.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER] != "node-a" {
+		t.Fatalf("Bad key id header '%s'", out.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER])
+	}
+
+	verified := out.Headers[shared.NATSHEADER_DNSTAPIR_VERIFIED_KEY_IDENTIFIERS]
+	if verified != "node-a,aggregator" {
+		t.Fatalf("Bad verified key ids header '%s'", verified)
+	}
+
+	thumbprints := strings.Split(out.Headers[shared.NATSHEADER_DNSTAPIR_VERIFIED_KEY_THUMBPRINTS], ",")
+	if len(thumbprints) != 2 || thumbprints[1] != keys.GetThumbprint(aggKey) {
+		t.Fatalf("Bad verified thumbprints header '%v'", thumbprints)
+	}
+}
+
+func TestAppDownDualSigning(t *testing.T) {
+	var tests = []struct {
+		name     string
+		retireAt string
+		kids     []string
+		expected []string
+	}{
+		{"BEFORE_CUTOVER", "2999-01-01T00:00:00Z", []string{"new-key", "old-key"}, []string{"new-key", "old-key"}},
+		{"AFTER_CUTOVER", "2000-01-01T00:00:00Z", []string{"new-key", "old-key"}, []string{"new-key"}},
+		{"OLD_KEY_REMOVED", "2000-01-01T00:00:00Z", []string{"new-key"}, []string{"new-key"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			keyfile := filepath.Join(workdir, "keys.jwks")
+
+			set := jwk.NewSet()
+			for _, kid := range tt.kids {
+				key := generateTestKey(t, filepath.Join(workdir, kid+".json"), kid)
+				err := set.AddKey(key)
+				if err != nil {
+					t.Fatalf("Error adding key: %s", err)
+				}
+			}
+			setJSON, err := json.Marshal(set)
+			if err != nil {
+				t.Fatalf("Error marshalling key set: %s", err)
+			}
+			err = os.WriteFile(keyfile, setJSON, 0600)
+			if err != nil {
+				t.Fatalf("Error writing key set: %s", err)
+			}
+
+			bridge := Bridge{
+				Direction:   "down",
+				MqttTopic:   "testtopic",
+				NatsSubject: "testsubject",
+				Key:         keyfile,
+				RetireKeyId: "old-key",
+				RetireKeyAt: tt.retireAt,
+			}
+			application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+			fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}")})
+			out := fakeMqtt.Eavesdrop()
+
+			err = application.Stop()
+			if err != nil {
+				t.Fatalf("Error stopping application: %s", err)
+			}
+
+			msg, err := keys.ParseSigned(out.Payload)
+			if err != nil {
+				t.Fatalf("Error parsing signed output: %s", err)
+			}
+
+			if msg.NumSignatures() != len(tt.expected) {
+				t.Fatalf("Got %d signatures, expected %d", msg.NumSignatures(), len(tt.expected))
+			}
+			for i, kid := range tt.expected {
+				if msg.SignatureKeyID(i) != kid {
+					t.Fatalf("Signature %d by '%s', expected '%s'", i, msg.SignatureKeyID(i), kid)
+				}
+			}
+		})
+	}
+}
+
+func TestAppRetireKeyNeedsTime(t *testing.T) {
+	application := App{
+		Log:     fake.Logger(),
+		Nats:    fake.Nats(),
+		Mqtt:    fake.Mqtt(),
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:   "down",
+				MqttTopic:   "testtopic",
+				NatsSubject: "testsubject",
+				RetireKeyId: "old-key",
+				RetireKeyAt: "next tuesday",
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err == nil {
+		t.Fatalf("Expected error for bad retirement time")
+	}
+}
+
+func TestAppDownReloadSigningKey(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	generateTestKey(t, keyfile, "key-before")
+
+	bridge := Bridge{
+		Direction:   "down",
+		MqttTopic:   "testtopic",
+		NatsSubject: "testsubject",
+		Key:         keyfile,
+	}
+	application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+	for _, kid := range []string{"key-before", "key-after"} {
+		if kid != "key-before" {
+			generateTestKey(t, keyfile, kid)
+
+			err := application.Reload(application.Bridges)
+			if err != nil {
+				t.Fatalf("Error reloading: %s", err)
+			}
+		}
+
+		fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}")})
+		out := fakeMqtt.Eavesdrop()
+
+		msg, err := keys.ParseSigned(out.Payload)
+		if err != nil {
+			t.Fatalf("Error parsing signed output: %s", err)
+		}
+		if msg.KeyID() != kid {
+			t.Fatalf("Signed by '%s', expected '%s'", msg.KeyID(), kid)
+		}
+	}
+
+	err := application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+}
+
+func TestAppReloadBridges(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	bridge := Bridge{
+		Direction:   "down",
+		MqttTopic:   "topic-a",
+		NatsSubject: "testsubject",
+		Key:         keyfile,
+	}
+	application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+	changed := bridge
+	changed.MqttTopic = "topic-b"
+	invalid := changed
+	invalid.MqttQos = 3
+
+	tests := []struct {
+		name    string
+		bridges []Bridge
+		wantErr bool
+		topic   string
+	}{
+		{"unchanged", []Bridge{bridge}, false, "topic-a"},
+		{"changed", []Bridge{changed}, false, "topic-b"},
+		{"invalid", []Bridge{invalid}, true, "topic-b"},
+		{"empty", []Bridge{}, true, "topic-b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := application.Reload(tt.bridges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload error '%v', expected error: %t", err, tt.wantErr)
+			}
+
+			fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}")})
+			out := fakeMqtt.Eavesdrop()
+			if out.Topic != tt.topic {
+				t.Fatalf("Published on '%s', expected '%s'", out.Topic, tt.topic)
+			}
+		})
+	}
+
+	err := application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+}
+
+func TestAppReloadStuckPublisher(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	signkey := generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	bridge := Bridge{
+		Direction:     "up",
+		MqttTopic:     "testtopic",
+		NatsSubject:   "testsubject",
+		NatsJetStream: true,
+		Key:           keyfile,
+	}
+	application, _, fakeMqtt := startUpBridge(t, bridge)
+
+	/*
+	 * Nothing is ever published, as while JetStream is unavailable. Enough
+	 * messages to fill the publisher, the worker queue and block dispatching.
+	 */
+	signedIn := signTestData(t, []byte("{\"foo\": \"bar\"}"), signkey)
+	for range 68 {
+		fakeMqtt.Inject(shared.MqttData{Payload: signedIn, Topic: "testtopic"})
+	}
+
+	changed := bridge
+	changed.NatsSubject = "othersubject"
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- application.Reload([]Bridge{changed})
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Error reloading: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		/* Not stopping the app, that would hang as well */
+		t.Fatalf("Reload did not return while publishing was stuck")
+	}
+
+	err := application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+}
+
+func TestAppDownSignClaims(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "testkey.json")
+	generateTestKey(t, keyfile, "tmp-key-utest-app")
+
+	bridge := Bridge{
+		Direction:     "down",
+		MqttTopic:     "testtopic",
+		NatsSubject:   "testsubject",
+		Key:           keyfile,
+		SignClaims:    true,
+		SignClaimsTtl: 300,
+	}
+	application, fakeNats, fakeMqtt := startDownBridge(t, bridge)
+
+	fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}")})
+	out := fakeMqtt.Eavesdrop()
+
+	msg, err := keys.ParseSigned(out.Payload)
+	if err != nil {
+		t.Fatalf("Error parsing signed output: %s", err)
+	}
+
+	claims, err := msg.SignatureClaims(0)
+	if err != nil {
+		t.Fatalf("Error getting claims: %s", err)
+	}
+	if claims.ID == "" || claims.Expiry.Sub(claims.IssuedAt) != 300*time.Second {
+		t.Fatalf("Bad claims %+v", claims)
+	}
+
+	err = application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+}
+
+func TestAppUpRejectsReplay(t *testing.T) {
+	fakeNats := fake.Nats()
+	fakeMqtt := fake.Mqtt()
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "testkey.json")
+
+	application := App{
+		Log:     fake.QuietLogger(),
+		Nats:    fakeNats,
+		Mqtt:    fakeMqtt,
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:         "up",
+				MqttTopic:         "testtopic",
+				NatsSubject:       "testsubject",
+				Key:               keyfile,
+				DeadLetterSubject: "deadletters",
+				MaxMessageAge:     60,
+				ClockSkew:         5,
+				ReplayWindow:      100,
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+
+	signkey, err := keys.GenerateSignKey(keyfile, "tmp-key-utest-app")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	application.Run()
+
+	claims, err := keys.NewClaims(time.Now(), 0)
+	if err != nil {
+		t.Fatalf("Error creating claims: %s", err)
+	}
+	signedIn, err := keys.SignWithClaims([]byte("{\"foo\": \"bar\"}"), signkey, claims)
+	if err != nil {
+		t.Fatalf("Error signing data: %s", err)
+	}
+
+	for _, wantReason := range []string{"", shared.REJECT_REASON_REPLAY} {
+		fakeMqtt.Inject(shared.MqttData{Payload: signedIn, Topic: "testtopic"})
+		out := fakeNats.Eavesdrop()
+
+		reason := out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON]
+		if reason != wantReason {
+			t.Fatalf("Got reject reason '%s', expected '%s'", reason, wantReason)
+		}
+	}
+
+	err = application.Stop()
+	if err != nil {
+		t.Fatalf("Error stopping application: %s", err)
+	}
+}
+
+func TestAppDownWatchFiles(t *testing.T) {
+	fakeNats := fake.Nats()
+	fakeMqtt := fake.Mqtt()
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "testkey.json")
+
+	application := App{
+		Log:     fake.Logger(),
+		Nats:    fakeNats,
+		Mqtt:    fakeMqtt,
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:   "down",
+				MqttTopic:   "testtopic",
+				NatsSubject: "testsubject",
+				Key:         keyfile,
+				WatchFiles:  true,
+			},
+		},
+	}
+
+	err := application.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+	application.watchInterval = 10 * time.Millisecond
+
+	_, err = keys.GenerateSignKey(keyfile, "key-before")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	application.Run()
+	defer application.Stop()
+
+	_, err = keys.GenerateSignKey(keyfile, "key-after-change")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	/* No explicit reload, the new key is picked up by the watcher */
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fakeNats.Inject(shared.NatsData{Payload: []byte("{\"foo\": \"bar\"}")})
+		out := fakeMqtt.Eavesdrop()
+
+		msg, err := keys.ParseSigned(out.Payload)
+		if err != nil {
+			t.Fatalf("Error parsing signed output: %s", err)
+		}
+		if msg.KeyID() == "key-after-change" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Still signed by '%s' after key change", msg.KeyID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAppTemplatePlaceholdersByDirection(t *testing.T) {
+	var tests = []struct {
+		name    string
+		bridge  Bridge
+		wantErr bool
+	}{
+		{"UP_TOPIC_IN_SUBJECT", Bridge{Direction: "up", MqttTopic: "events/up/+", NatsSubject: "events.{topic[2]}"}, false},
+		{"UP_SUBJECT_IN_SUBJECT", Bridge{Direction: "up", MqttTopic: "events/up/+", NatsSubject: "events.{subject[1]}"}, true},
+		{"DOWN_SUBJECT_IN_TOPIC", Bridge{Direction: "down", MqttTopic: "obs/{subject[1]}", NatsSubject: "obs.*"}, false},
+		{"DOWN_TOPIC_IN_TOPIC", Bridge{Direction: "down", MqttTopic: "obs/{topic[1]}", NatsSubject: "obs.*"}, true},
+		{"UNKNOWN", Bridge{Direction: "down", MqttTopic: "obs/{foo}", NatsSubject: "obs.*"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := App{
+				Log:     fake.Logger(),
+				Nats:    fake.Nats(),
+				Mqtt:    fake.Mqtt(),
+				Nodeman: fake.Nodeman(),
+				Bridges: []Bridge{tt.bridge},
+			}
+
+			err := application.Initialize()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Got error '%v', expected error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAppUpDeadLetter(t *testing.T) {
+	fakeNats := fake.Nats()
+	fakeMqtt := fake.Mqtt()
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "testkey.json")
+	forgedfile := filepath.Join(workdir, "forgedkey.json")
+	schemafile := filepath.Join(workdir, "schema.json")
+
+	err := os.WriteFile(schemafile, []byte(`{"type": "object", "required": ["foo"]}`), 0640)
+	if err != nil {
+		t.Fatalf("Error writing schema: %s", err)
+	}
+
+	application := App{
+		Log:     fake.QuietLogger(),
+		Nats:    fakeNats,
+		Mqtt:    fakeMqtt,
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:         "up",
+				MqttTopic:         "testtopic",
+				NatsSubject:       "testsubject",
+				Key:               keyfile,
+				Schema:            schemafile,
+				DeadLetterSubject: "deadletters",
+			},
+		},
+	}
+
+	err = application.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+	defer application.Stop()
+
+	signkey, err := keys.GenerateSignKey(keyfile, "tmp-key-utest-app")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	forgedkey, err := keys.GenerateSignKey(forgedfile, "tmp-key-utest-app")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	application.Run()
+
+	var tests = []struct {
+		name       string
+		key        keys.SignKey
+		data       string
+		wantReason string
+	}{
+		{"BAD_SIGNATURE", forgedkey, `{"foo": "bar"}`, shared.REJECT_REASON_BAD_SIGNATURE},
+		{"SCHEMA", signkey, `{"bar": "foo"}`, shared.REJECT_REASON_SCHEMA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signedIn, err := keys.Sign([]byte(tt.data), tt.key)
+			if err != nil {
+				t.Fatalf("Error signing data: %s", err)
+			}
+
+			fakeMqtt.Inject(shared.MqttData{Payload: signedIn, Topic: "testtopic"})
+			out := fakeNats.Eavesdrop()
+
+			if out.Subject != "deadletters" {
+				t.Fatalf("Got subject '%s', expected 'deadletters'", out.Subject)
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON] != tt.wantReason {
+				t.Fatalf("Got reject reason '%s', expected '%s'", out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON], tt.wantReason)
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_ERROR] == "" {
+				t.Fatalf("No reject error header")
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC] != "testtopic" {
+				t.Fatalf("Got topic header '%s', expected 'testtopic'", out.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC])
+			}
+			if string(out.Payload) != string(signedIn) {
+				t.Fatalf("Dead-lettered payload modified, want: '%s', got: '%s'", signedIn, out.Payload)
+			}
+		})
+	}
+}
+
+func TestAppDownDeadLetter(t *testing.T) {
+	fakeNats := fake.Nats()
+	fakeMqtt := fake.Mqtt()
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "testkey.json")
+	schemafile := filepath.Join(workdir, "schema.json")
+
+	err := os.WriteFile(schemafile, []byte(`{"type": "object", "required": ["foo"]}`), 0640)
+	if err != nil {
+		t.Fatalf("Error writing schema: %s", err)
+	}
+
+	application := App{
+		Log:     fake.QuietLogger(),
+		Nats:    fakeNats,
+		Mqtt:    fakeMqtt,
+		Nodeman: fake.Nodeman(),
+		Bridges: []Bridge{
+			{
+				Direction:         "down",
+				MqttTopic:         "testtopic/{subject[1]}",
+				NatsSubject:       "testsubject.*",
+				Key:               keyfile,
+				Schema:            schemafile,
+				DeadLetterSubject: "deadletters",
+			},
+		},
+	}
+
+	err = application.Initialize()
+	if err != nil {
+		t.Fatalf("Error initializing app: %s", err)
+	}
+	defer application.Stop()
+
+	_, err = keys.GenerateSignKey(keyfile, "tmp-key-utest-app")
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	application.Run()
+
+	var tests = []struct {
+		name       string
+		subject    string
+		data       string
+		wantReason string
+	}{
+		{"SCHEMA", "testsubject.a", `{"bar": "foo"}`, shared.REJECT_REASON_SCHEMA},
+		{"TEMPLATE", "testsubject", `{"foo": "bar"}`, shared.REJECT_REASON_TEMPLATE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := []byte(tt.data)
+			fakeNats.Inject(shared.NatsData{Payload: in, Subject: tt.subject})
+			out := fakeNats.Eavesdrop()
+
+			if out.Subject != "deadletters" {
+				t.Fatalf("Got subject '%s', expected 'deadletters'", out.Subject)
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON] != tt.wantReason {
+				t.Fatalf("Got reject reason '%s', expected '%s'", out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON], tt.wantReason)
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_ERROR] == "" {
+				t.Fatalf("No reject error header")
+			}
+			if out.Headers[shared.NATSHEADER_DNSTAPIR_NATS_SUBJECT] != tt.subject {
+				t.Fatalf("Got subject header '%s', expected '%s'", out.Headers[shared.NATSHEADER_DNSTAPIR_NATS_SUBJECT], tt.subject)
+			}
+			if string(out.Payload) != string(in) {
+				t.Fatalf("Dead-lettered payload modified, want: '%s', got: '%s'", in, out.Payload)
+			}
+		})
+	}
+}
@@ -1,35 +1,92 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/shared"
 
-	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/sync/singleflight"
 )
 
 const cCACHE_SIZE = 1000
+const cNEGATIVE_CACHE_SIZE = 1000
+const cNEGATIVE_TTL = 1 * time.Minute
 
 type LruCache struct {
-	valKeyCache *lru.Cache[string, keys.ValKey]
+	valKeyCache *expirable.LRU[string, keys.ValKey]
+	negCache    *expirable.LRU[string, error]
+	inflight    singleflight.Group
+	pinned      pinnedMu
+	fetching    fetchingMu
+}
+
+/* Statically configured keys, never evicted nor revoked */
+type pinnedMu struct {
+	sync.RWMutex
+	keys map[string]keys.ValKey
 }
 
+/* Key IDs being fetched, and whether they were revoked meanwhile */
+type fetchingMu struct {
+	sync.Mutex
+	revoked map[string]bool
+}
+
+var errRevokedWhileFetching = errors.New("key revoked while fetching")
+
+type FetchFunc func(keyID string) (keys.ValKey, error)
+
 type Conf struct {
+	Size        int           // Number of fetched keys, optional
+	TTL         time.Duration // Fetch keys again after this long, optional
+	NegativeTTL time.Duration // Remember unknown keys this long, optional
 }
 
 func Create(conf Conf) (*LruCache, error) {
 	newCache := new(LruCache)
 
-	newLru, err := lru.New[string, keys.ValKey](cCACHE_SIZE)
-	if err != nil {
-		return nil, err
+	if conf.Size < 0 {
+		return nil, errors.New("bad cache size")
+	}
+	size := conf.Size
+	if size == 0 {
+		size = cCACHE_SIZE
+	}
+
+	/* Without a ttl keys are only evicted when the cache is full */
+	if conf.TTL < 0 {
+		return nil, errors.New("bad cache ttl")
 	}
+	newCache.valKeyCache = expirable.NewLRU[string, keys.ValKey](size, nil, conf.TTL)
+	newCache.pinned.keys = make(map[string]keys.ValKey)
+	newCache.fetching.revoked = make(map[string]bool)
 
-	newCache.valKeyCache = newLru
+	if conf.NegativeTTL < 0 {
+		return nil, errors.New("bad negative cache ttl")
+	}
+	negativeTTL := conf.NegativeTTL
+	if negativeTTL == 0 {
+		negativeTTL = cNEGATIVE_TTL
+	}
+	newCache.negCache = expirable.NewLRU[string, error](cNEGATIVE_CACHE_SIZE, nil, negativeTTL)
 
 	return newCache, nil
 }
 
 func (l *LruCache) GetValkeyFromCache(keyID string) keys.ValKey {
-	key, ok := l.valKeyCache.Get(keyID)
+	l.pinned.RLock()
+	key, ok := l.pinned.keys[keyID]
+	l.pinned.RUnlock()
+	if ok {
+		return key
+	}
+
+	key, ok = l.valKeyCache.Get(keyID)
 
 	if !ok {
 		return nil
@@ -42,3 +99,102 @@ func (l *LruCache) StoreValkeyInCache(key keys.ValKey) error {
 	l.valKeyCache.Add(key.KeyID(), key)
 	return nil
 }
+
+/* Replaces all pinned keys, e.g. when a key directory has changed */
+func (l *LruCache) SetPinnedValkeys(valKeys []keys.ValKey) error {
+	newPinned := make(map[string]keys.ValKey, len(valKeys))
+	for _, key := range valKeys {
+		if key.KeyID() == "" {
+			return errors.New("pinned key has no key id")
+		}
+		newPinned[key.KeyID()] = key
+	}
+
+	l.pinned.Lock()
+	l.pinned.keys = newPinned
+	l.pinned.Unlock()
+
+	return nil
+}
+
+/* Returns false if the key is pinned and thus kept */
+func (l *LruCache) RevokeValkey(keyID string) bool {
+	l.pinned.RLock()
+	_, ok := l.pinned.keys[keyID]
+	l.pinned.RUnlock()
+	if ok {
+		return false
+	}
+
+	l.fetching.Lock()
+	_, ok = l.fetching.revoked[keyID]
+	if ok {
+		l.fetching.revoked[keyID] = true
+	}
+	l.valKeyCache.Remove(keyID)
+	l.fetching.Unlock()
+
+	return true
+}
+
+/*
+ * Get a key from the cache, fetching it on a miss. Concurrent misses for the
+ * same key ID share a single fetch and the result is stored once, unless the
+ * key was revoked during the fetch. Keys that nodeman does not know are not
+ * fetched again until the negative entry has expired.
+ */
+func (l *LruCache) GetOrFetchValkey(keyID string, fetch FetchFunc) (keys.ValKey, bool, error) {
+	key := l.GetValkeyFromCache(keyID)
+	if key != nil {
+		return key, true, nil
+	}
+
+	negErr, ok := l.negCache.Get(keyID)
+	if ok {
+		return nil, true, fmt.Errorf("negatively cached: %w", negErr)
+	}
+
+	val, err, _ := l.inflight.Do(keyID, func() (any, error) {
+		/* Another caller may have finished fetching since the miss */
+		key := l.GetValkeyFromCache(keyID)
+		if key != nil {
+			return key, nil
+		}
+
+		l.fetching.Lock()
+		l.fetching.revoked[keyID] = false
+		l.fetching.Unlock()
+
+		newKey, err := fetch(keyID)
+
+		/* A revocation during the fetch must not be undone by storing */
+		l.fetching.Lock()
+		defer l.fetching.Unlock()
+
+		revoked := l.fetching.revoked[keyID]
+		delete(l.fetching.revoked, keyID)
+
+		if errors.Is(err, shared.ErrNodemanKeyNotFound) {
+			l.negCache.Add(keyID, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if revoked {
+			return nil, errRevokedWhileFetching
+		}
+
+		err = l.StoreValkeyInCache(newKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return newKey, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return val.(keys.ValKey), false, nil
+}
@@ -0,0 +1,236 @@
+package cache
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+)
+
+func TestGetOrFetchValkeyCoalesces(t *testing.T) {
+	err := keys.SetLogger(fake.Logger())
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := keys.GenerateValKey(filepath.Join(t.TempDir(), "key.json"), "utest-cache")
+	if err != nil {
+		panic(err)
+	}
+
+	lruCache, err := Create(Conf{})
+	if err != nil {
+		panic(err)
+	}
+
+	var fetches atomic.Int32
+	fetch := func(keyID string) (keys.ValKey, error) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return key, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, _, err := lruCache.GetOrFetchValkey("utest-cache", fetch)
+			if err != nil || got == nil {
+				t.Errorf("fetch failed, err: '%v'", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetches.Load() != 1 {
+		t.Fatalf("expected 1 fetch, got %d", fetches.Load())
+	}
+
+	_, cached, err := lruCache.GetOrFetchValkey("utest-cache", fetch)
+	if err != nil || !cached {
+		t.Fatalf("expected cached key, err: '%v'", err)
+	}
+}
+
+func TestGetOrFetchValkeyNegative(t *testing.T) {
+	var tests = []struct {
+		name     string
+		fetchErr error
+		fetches  int32
+	}{
+		{"NOT_FOUND_CACHED", shared.ErrNodemanKeyNotFound, 1},
+		{"UNAVAILABLE_NOT_CACHED", shared.ErrNodemanUnavailable, 3},
+		{"OTHER_NOT_CACHED", errors.New("connection refused"), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lruCache, err := Create(Conf{NegativeTTL: time.Hour})
+			if err != nil {
+				panic(err)
+			}
+
+			var fetches atomic.Int32
+			fetch := func(keyID string) (keys.ValKey, error) {
+				fetches.Add(1)
+				return nil, tt.fetchErr
+			}
+
+			for range 3 {
+				_, _, err := lruCache.GetOrFetchValkey("utest-unknown", fetch)
+				if !errors.Is(err, tt.fetchErr) {
+					t.Fatalf("got err '%v', expected '%v'", err, tt.fetchErr)
+				}
+			}
+
+			if fetches.Load() != tt.fetches {
+				t.Fatalf("expected %d fetches, got %d", tt.fetches, fetches.Load())
+			}
+		})
+	}
+}
+
+func TestRevokeValkey(t *testing.T) {
+	err := keys.SetLogger(fake.Logger())
+	if err != nil {
+		panic(err)
+	}
+
+	workdir := t.TempDir()
+	pinnedKey, err := keys.GenerateValKey(filepath.Join(workdir, "pinned.json"), "utest-pinned")
+	if err != nil {
+		panic(err)
+	}
+	fetchedKey, err := keys.GenerateValKey(filepath.Join(workdir, "fetched.json"), "utest-fetched")
+	if err != nil {
+		panic(err)
+	}
+
+	lruCache, err := Create(Conf{})
+	if err != nil {
+		panic(err)
+	}
+
+	err = lruCache.SetPinnedValkeys([]keys.ValKey{pinnedKey})
+	if err != nil {
+		panic(err)
+	}
+	err = lruCache.StoreValkeyInCache(fetchedKey)
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name    string
+		keyID   string
+		revoked bool
+	}{
+		{"PINNED", "utest-pinned", false},
+		{"FETCHED", "utest-fetched", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lruCache.RevokeValkey(tt.keyID)
+			if got != tt.revoked {
+				t.Fatalf("revoke returned %t, expected %t", got, tt.revoked)
+			}
+
+			inCache := lruCache.GetValkeyFromCache(tt.keyID) != nil
+			if inCache == tt.revoked {
+				t.Fatalf("key in cache: %t after revocation", inCache)
+			}
+		})
+	}
+}
+
+func TestRevokeValkeyWhileFetching(t *testing.T) {
+	err := keys.SetLogger(fake.Logger())
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := keys.GenerateValKey(filepath.Join(t.TempDir(), "key.json"), "utest-revoked")
+	if err != nil {
+		panic(err)
+	}
+
+	lruCache, err := Create(Conf{})
+	if err != nil {
+		panic(err)
+	}
+
+	fetching := make(chan bool)
+	release := make(chan bool)
+	slowFetch := func(keyID string) (keys.ValKey, error) {
+		fetching <- true
+		<-release
+		return key, nil
+	}
+
+	errCh := make(chan error)
+	go func() {
+		_, _, err := lruCache.GetOrFetchValkey("utest-revoked", slowFetch)
+		errCh <- err
+	}()
+
+	<-fetching
+	if !lruCache.RevokeValkey("utest-revoked") {
+		t.Fatalf("revoke returned false for a fetched key")
+	}
+	close(release)
+
+	err = <-errCh
+	if !errors.Is(err, errRevokedWhileFetching) {
+		t.Fatalf("got err '%v', expected '%v'", err, errRevokedWhileFetching)
+	}
+	if lruCache.GetValkeyFromCache("utest-revoked") != nil {
+		t.Fatalf("key revoked during the fetch was stored")
+	}
+
+	/* Only that fetch is affected */
+	fetch := func(keyID string) (keys.ValKey, error) {
+		return key, nil
+	}
+	got, cached, err := lruCache.GetOrFetchValkey("utest-revoked", fetch)
+	if err != nil || got == nil || cached {
+		t.Fatalf("fetch after revocation failed, cached: %t, err: '%v'", cached, err)
+	}
+}
+
+func TestValkeyTTL(t *testing.T) {
+	err := keys.SetLogger(fake.Logger())
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := keys.GenerateValKey(filepath.Join(t.TempDir(), "key.json"), "utest-ttl")
+	if err != nil {
+		panic(err)
+	}
+
+	lruCache, err := Create(Conf{TTL: 20 * time.Millisecond})
+	if err != nil {
+		panic(err)
+	}
+
+	err = lruCache.StoreValkeyInCache(key)
+	if err != nil {
+		panic(err)
+	}
+	if lruCache.GetValkeyFromCache("utest-ttl") == nil {
+		t.Fatalf("key missing before ttl")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if lruCache.GetValkeyFromCache("utest-ttl") != nil {
+		t.Fatalf("key still cached after ttl")
+	}
+}
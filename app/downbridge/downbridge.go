@@ -2,24 +2,57 @@ package downbridge
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/dnstapir/mqtt-bridge/shared"
 
 	"github.com/dnstapir/mqtt-bridge/app/keys"
 	"github.com/dnstapir/mqtt-bridge/app/schemaval"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
 )
 
+/* Redelivery delay for durable consumer messages that could not be bridged */
+const cNAK_DELAY = 5 * time.Second
+
 type downbridge struct {
-	log       shared.LoggerIF
-	stopCh    chan bool
-	key       keys.SignKey
-	schemaval *schemaval.Schemaval
+	log        shared.LoggerIF
+	stopCh     chan bool
+	keyPath    string
+	schemaPath string
+	algs       []jwa.SignatureAlgorithm
+	retireID   string
+	retireAt   time.Time
+	signing    atomic.Pointer[signState]
+	schemaval  atomic.Pointer[schemaval.Schemaval]
+	topic      *templates.Template
+	deadCh     chan<- shared.NatsData
+	claims     bool
+	claimsTTL  time.Duration
+}
+
+/* Replaced as a whole on reload and when a key is retired */
+type signState struct {
+	keys    []keys.SignKey
+	retired bool
 }
 
 type Conf struct {
-	Log    shared.LoggerIF
-	Schema string
-	Key    string
+	Log          shared.LoggerIF
+	Topic        *templates.Template
+	DeadLetterCh chan<- shared.NatsData // Rejected messages, optional
+	Schema       string
+	Key          string   // JWK or JWKS, every key signs
+	Algorithms   []string // All supported if empty
+	RetireKeyID  string   // Key to stop signing with at RetireKeyAt, optional
+	RetireKeyAt  time.Time
+	Claims       bool          // Add iat and jti to each signature
+	ClaimsTTL    time.Duration // Also add exp, optional
 }
 
 func Create(conf Conf) (*downbridge, error) {
@@ -30,46 +63,87 @@ func Create(conf Conf) (*downbridge, error) {
 	}
 	newDownbridge.log = conf.Log
 
+	if conf.Topic == nil {
+		return nil, errors.New("error setting topic template")
+	}
+	newDownbridge.topic = conf.Topic
+	newDownbridge.deadCh = conf.DeadLetterCh
+
 	newDownbridge.stopCh = make(chan bool, 1)
 
-	key, err := keys.GetSignKey(conf.Key)
+	if conf.ClaimsTTL < 0 || (conf.ClaimsTTL > 0 && !conf.Claims) {
+		return nil, errors.New("bad claims ttl")
+	}
+	newDownbridge.claims = conf.Claims
+	newDownbridge.claimsTTL = conf.ClaimsTTL
+
+	algs, err := keys.ParseAlgorithms(conf.Algorithms)
 	if err != nil {
-		return nil, errors.New("error getting signing key")
+		return nil, err
 	}
-	newDownbridge.key = key
+	newDownbridge.algs = algs
 
-	schemaConf := schemaval.Conf{
-		Log:      conf.Log,
-		Filename: conf.Schema,
+	newDownbridge.keyPath = conf.Key
+	newDownbridge.retireID = conf.RetireKeyID
+	newDownbridge.retireAt = conf.RetireKeyAt
+	state, err := newDownbridge.loadSignKeys(time.Now())
+	if err != nil {
+		return nil, err
 	}
-	schema, err := schemaval.Create(schemaConf)
+	newDownbridge.signing.Store(state)
+
+	newDownbridge.schemaPath = conf.Schema
+	schema, err := newDownbridge.loadSchema()
 	if err != nil {
 		return nil, err
 	}
-	newDownbridge.schemaval = schema
+	newDownbridge.schemaval.Store(schema)
 
 	return newDownbridge, nil
 }
 
-func (db *downbridge) Start(natsCh <-chan []byte, mqttCh chan<- []byte) {
+func (db *downbridge) Start(natsCh <-chan shared.NatsData, mqttCh chan<- shared.MqttData) {
 	for {
 		select {
 		case <-db.stopCh:
 			db.log.Info("Stopping downbound bridge")
 			return
-		case data := <-natsCh:
-			db.log.Debug("Got message '%s'", string(data))
+		case natsData, ok := <-natsCh:
+			if !ok {
+				db.log.Warning("NATS channel closed, stopping downbound bridge")
+				return
+			}
+			data := natsData.Payload
+			db.log.Debug("Got message '%s' on subject '%s'", string(data), natsData.Subject)
+
+			topic, err := db.getTopic(natsData)
+			if err != nil {
+				db.log.Error("Error getting MQTT topic for subject '%s', err: '%s'", natsData.Subject, err)
+				db.deadLetter(natsData, shared.REJECT_REASON_TEMPLATE, err)
+				db.term(natsData)
+				continue
+			}
 
-			ok := db.schemaval.Validate(data)
-			if ok {
-				outData, err := keys.Sign(data, db.key)
+			err = db.schemaval.Load().Validate(data)
+			if err == nil {
+				outData, err := db.sign(data, time.Now())
 				if err == nil {
-					mqttCh <- outData
+					mqttCh <- shared.MqttData{
+						Topic:   topic,
+						Payload: outData,
+						Done:    db.publishDoneCb(natsData),
+					}
 				} else {
 					db.log.Error("Error signing data from NATS, discarding...")
+					if natsData.Acker == nil {
+						db.deadLetter(natsData, shared.REJECT_REASON_SIGNING, err)
+					}
+					db.nak(natsData)
 				}
 			} else {
 				db.log.Error("Malformed data from NATS, discarding...")
+				db.deadLetter(natsData, shared.REJECT_REASON_SCHEMA, err)
+				db.term(natsData)
 			}
 		}
 	}
@@ -77,6 +151,221 @@ func (db *downbridge) Start(natsCh <-chan []byte, mqttCh chan<- []byte) {
 	// TODO also close other channels?
 }
 
+func (db *downbridge) loadSignKeys(now time.Time) (*signState, error) {
+	signKeys, err := keys.GetSignKeys(db.keyPath)
+	if err != nil {
+		return nil, errors.New("error getting signing key")
+	}
+
+	for _, key := range signKeys {
+		alg, ok := key.Algorithm().(jwa.SignatureAlgorithm)
+		if !ok {
+			return nil, errors.New("signing key has no signature algorithm")
+		}
+
+		err = keys.CheckKeyAlgorithm(key, alg, db.algs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if db.retireID == "" {
+		return &signState{keys: signKeys}, nil
+	}
+
+	found := slices.ContainsFunc(signKeys, func(key keys.SignKey) bool {
+		return key.KeyID() == db.retireID
+	})
+
+	if now.Before(db.retireAt) {
+		if !found || len(signKeys) < 2 {
+			return nil, errors.New("key to retire must be one of several signing keys")
+		}
+		return &signState{keys: signKeys}, nil
+	}
+
+	/* After the cut-over the old key is dropped, or may already be gone */
+	if found {
+		db.log.Info("Signing key '%s' retired as of %s", db.retireID, db.retireAt)
+	} else {
+		db.log.Info("Retired signing key '%s' no longer configured, the key retirement settings can be removed", db.retireID)
+	}
+	remaining := slices.DeleteFunc(signKeys, func(key keys.SignKey) bool {
+		return key.KeyID() == db.retireID
+	})
+	if len(remaining) == 0 {
+		return nil, errors.New("no signing key left besides the retired one")
+	}
+
+	return &signState{keys: remaining, retired: true}, nil
+}
+
+func (db *downbridge) loadSchema() (*schemaval.Schemaval, error) {
+	schemaConf := schemaval.Conf{
+		Log:      db.log,
+		Filename: db.schemaPath,
+	}
+
+	return schemaval.Create(schemaConf)
+}
+
+/*
+ * Load signing keys and schema again, e.g. on SIGHUP. Each is only replaced
+ * if the new one is valid.
+ */
+func (db *downbridge) Reload() error {
+	var errs []error
+
+	state, err := db.loadSignKeys(time.Now())
+	if err != nil {
+		errs = append(errs, fmt.Errorf("signing keys '%s': %w", db.keyPath, err))
+	} else {
+		db.signing.Store(state)
+		db.log.Info("Reloaded %d signing keys from '%s'", len(state.keys), db.keyPath)
+	}
+
+	schema, err := db.loadSchema()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("schema '%s': %w", db.schemaPath, err))
+	} else {
+		db.schemaval.Store(schema)
+		db.log.Info("Reloaded schema '%s'", db.schemaPath)
+	}
+
+	return errors.Join(errs...)
+}
+
+/* During a rollover both keys sign, until the old one is retired */
+func (db *downbridge) signingKeys(now time.Time) []keys.SignKey {
+	state := db.signing.Load()
+	if db.retireID == "" || state.retired || now.Before(db.retireAt) {
+		return state.keys
+	}
+
+	newState := &signState{
+		keys: slices.DeleteFunc(slices.Clone(state.keys), func(key keys.SignKey) bool {
+			return key.KeyID() == db.retireID
+		}),
+		retired: true,
+	}
+
+	/* A concurrent reload wins, the key is retired on the next message */
+	if db.signing.CompareAndSwap(state, newState) {
+		db.log.Info("Signing key '%s' retired as of %s", db.retireID, db.retireAt)
+	}
+
+	return newState.keys
+}
+
+/*
+ * The target topic is taken from the DNSTAPIR-Mqtt-Topic header if present,
+ * else the topic template is filled in from the NATS subject tokens
+ */
+func (db *downbridge) getTopic(natsData shared.NatsData) (string, error) {
+	topic, ok := natsData.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC]
+	if ok {
+		if topic == "" || strings.ContainsAny(topic, "+#\x00") {
+			return "", errors.New("invalid topic in header")
+		}
+		db.log.Debug("Topic '%s' set by header", topic)
+		return topic, nil
+	}
+
+	vars := templates.Vars{
+		Subject: strings.Split(natsData.Subject, "."),
+	}
+
+	return db.topic.Execute(vars)
+}
+
+/*
+ * Messages from durable consumers are acked once the MQTT client has
+ * published them, else they are redelivered after a delay
+ */
+func (db *downbridge) publishDoneCb(natsData shared.NatsData) func(error) {
+	if natsData.Acker == nil {
+		return nil
+	}
+
+	return func(err error) {
+		if err != nil {
+			db.nak(natsData)
+			return
+		}
+
+		err = natsData.Acker.Ack()
+		if err != nil {
+			db.log.Warning("Error acking NATS message on subject '%s', err: '%s'", natsData.Subject, err)
+		}
+	}
+}
+
+func (db *downbridge) nak(natsData shared.NatsData) {
+	if natsData.Acker == nil {
+		return
+	}
+
+	err := natsData.Acker.NakWithDelay(cNAK_DELAY)
+	if err != nil {
+		db.log.Warning("Error nak'ing NATS message on subject '%s', err: '%s'", natsData.Subject, err)
+	}
+}
+
+/* Malformed messages are never redelivered */
+func (db *downbridge) term(natsData shared.NatsData) {
+	if natsData.Acker == nil {
+		return
+	}
+
+	err := natsData.Acker.Term()
+	if err != nil {
+		db.log.Warning("Error terminating NATS message on subject '%s', err: '%s'", natsData.Subject, err)
+	}
+}
+
+/*
+ * Hand over the unsigned message for inspection and replay, if configured.
+ * Messages that will be redelivered by a durable consumer are not
+ * dead-lettered.
+ */
+func (db *downbridge) deadLetter(natsData shared.NatsData, reason string, err error) {
+	if db.deadCh == nil {
+		return
+	}
+
+	deadMsg := shared.NatsData{
+		Payload: natsData.Payload,
+		Headers: make(map[string]string),
+	}
+
+	for _, h := range shared.NATSHEADERS_DNSTAPIR_ALL {
+		val, ok := natsData.Headers[h]
+		if ok {
+			deadMsg.Headers[h] = val
+		}
+	}
+
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON] = reason
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_ERROR] = shared.HeaderValue(err.Error())
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_NATS_SUBJECT] = natsData.Subject
+
+	db.deadCh <- deadMsg
+	db.log.Debug("Dead-lettered message on subject '%s', reason: '%s'", natsData.Subject, reason)
+}
+
+func (db *downbridge) sign(data []byte, now time.Time) ([]byte, error) {
+	var claims *keys.Claims
+	if db.claims {
+		var err error
+		claims, err = keys.NewClaims(now, db.claimsTTL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys.SignAll(data, db.signingKeys(now), claims)
+}
+
 func (db *downbridge) Stop() {
 	db.stopCh <- true
 	close(db.stopCh)
@@ -0,0 +1,163 @@
+package downbridge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+)
+
+func TestReloadKeepsOldOnError(t *testing.T) {
+	log := fake.QuietLogger()
+	err := keys.SetLogger(log)
+	if err != nil {
+		panic(err)
+	}
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "key.json")
+	schemafile := filepath.Join(workdir, "schema.json")
+
+	_, err = keys.GenerateSignKey(keyfile, "key-old")
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(schemafile, []byte(`{"type": "object"}`), 0640)
+	if err != nil {
+		panic(err)
+	}
+
+	topic, err := templates.ForMqttTopic("testtopic")
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := Create(Conf{Log: log, Topic: topic, Key: keyfile, Schema: schemafile})
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name string
+		file string
+		data string
+	}{
+		{"BAD_KEY", keyfile, "not a key"},
+		{"PUBLIC_KEY", keyfile, `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`},
+		{"BAD_SCHEMA", schemafile, "not a schema"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig, err := os.ReadFile(tt.file)
+			if err != nil {
+				panic(err)
+			}
+			defer os.WriteFile(tt.file, orig, 0640)
+
+			oldSchema := db.schemaval.Load()
+			err = os.WriteFile(tt.file, []byte(tt.data), 0640)
+			if err != nil {
+				panic(err)
+			}
+
+			err = db.Reload()
+			if err == nil {
+				t.Fatalf("Expected reload error")
+			}
+
+			signKeys := db.signingKeys(db.retireAt)
+			if len(signKeys) != 1 || signKeys[0].KeyID() != "key-old" {
+				t.Fatalf("Signing key replaced by invalid one")
+			}
+			if tt.file == schemafile && db.schemaval.Load() != oldSchema {
+				t.Fatalf("Schema replaced by invalid one")
+			}
+		})
+	}
+}
+
+func TestSigningErrorNaksDurable(t *testing.T) {
+	log := fake.QuietLogger()
+	err := keys.SetLogger(log)
+	if err != nil {
+		panic(err)
+	}
+
+	workdir := t.TempDir()
+	keyfile := filepath.Join(workdir, "key.json")
+
+	signKey, err := keys.GenerateSignKey(keyfile, "key")
+	if err != nil {
+		panic(err)
+	}
+	valKey, err := keys.ToValkey(signKey)
+	if err != nil {
+		panic(err)
+	}
+
+	topic, err := templates.ForMqttTopic("testtopic")
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name     string
+		durable  bool
+		wantDead bool
+	}{
+		{"DURABLE", true, false},
+		{"NOT_DURABLE", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadCh := make(chan shared.NatsData, 1)
+			db, err := Create(Conf{Log: log, Topic: topic, Key: keyfile, DeadLetterCh: deadCh})
+			if err != nil {
+				panic(err)
+			}
+
+			/* A public key can't sign */
+			db.signing.Store(&signState{keys: []keys.SignKey{keys.SignKey(valKey)}})
+
+			natsCh := make(chan shared.NatsData)
+			mqttCh := make(chan shared.MqttData, 1)
+			done := make(chan bool)
+			go func() {
+				db.Start(natsCh, mqttCh)
+				close(done)
+			}()
+
+			acker := fake.Acker()
+			natsData := shared.NatsData{Payload: []byte(`{"foo": "bar"}`), Subject: "testsubject"}
+			if tt.durable {
+				natsData.Acker = acker
+			}
+			natsCh <- natsData
+			close(natsCh)
+			<-done
+
+			if len(mqttCh) != 0 {
+				t.Fatalf("Message published despite signing error")
+			}
+			if tt.durable && (!acker.Naked || acker.Acked || acker.Termed) {
+				t.Fatalf("Unexpected ack state, acked: %t, naked: %t, termed: %t", acker.Acked, acker.Naked, acker.Termed)
+			}
+
+			if tt.wantDead != (len(deadCh) == 1) {
+				t.Fatalf("Dead-lettered: %t, expected: %t", len(deadCh) == 1, tt.wantDead)
+			}
+			if tt.wantDead {
+				dead := <-deadCh
+				if dead.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON] != shared.REJECT_REASON_SIGNING {
+					t.Fatalf("Got reject reason '%s', expected '%s'", dead.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON], shared.REJECT_REASON_SIGNING)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package keys
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+/* Asymmetric algorithms only, "none" and HMAC are never accepted */
+var supportedAlgorithms = []jwa.SignatureAlgorithm{
+	jwa.EdDSA,
+	jwa.ES256,
+	jwa.ES384,
+	jwa.ES512,
+	jwa.RS256,
+	jwa.RS384,
+	jwa.RS512,
+	jwa.PS256,
+	jwa.PS384,
+	jwa.PS512,
+}
+
+var ecCurves = map[jwa.SignatureAlgorithm]jwa.EllipticCurveAlgorithm{
+	jwa.ES256: jwa.P256,
+	jwa.ES384: jwa.P384,
+	jwa.ES512: jwa.P521,
+}
+
+/* An empty list allows all supported algorithms */
+func ParseAlgorithms(names []string) ([]jwa.SignatureAlgorithm, error) {
+	if len(names) == 0 {
+		return slices.Clone(supportedAlgorithms), nil
+	}
+
+	algs := make([]jwa.SignatureAlgorithm, 0, len(names))
+	for _, name := range names {
+		alg := jwa.SignatureAlgorithm(name)
+		if !slices.Contains(supportedAlgorithms, alg) {
+			return nil, fmt.Errorf("unsupported algorithm '%s'", name)
+		}
+		algs = append(algs, alg)
+	}
+
+	return algs, nil
+}
+
+/*
+ * Check that a key may be used with an algorithm. A key that names its
+ * algorithm must name this one, and the key type and curve must fit.
+ */
+func CheckKeyAlgorithm(key jwk.Key, alg jwa.SignatureAlgorithm, allowed []jwa.SignatureAlgorithm) error {
+	if !slices.Contains(allowed, alg) {
+		return fmt.Errorf("algorithm '%s' not allowed", alg)
+	}
+
+	keyAlg := key.Algorithm().String()
+	if keyAlg != "" && keyAlg != alg.String() {
+		return fmt.Errorf("algorithm '%s' does not match key algorithm '%s'", alg, keyAlg)
+	}
+
+	var ok bool
+	switch key.KeyType() {
+	case jwa.OKP:
+		ok = alg == jwa.EdDSA && keyCurve(key) == jwa.Ed25519
+	case jwa.EC:
+		crv, isEC := ecCurves[alg]
+		ok = isEC && keyCurve(key) == crv
+	case jwa.RSA:
+		ok = slices.Contains([]jwa.SignatureAlgorithm{jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512}, alg)
+	}
+	if !ok {
+		return fmt.Errorf("algorithm '%s' does not fit key type '%s'", alg, key.KeyType())
+	}
+
+	return nil
+}
+
+type curveKey interface {
+	Crv() jwa.EllipticCurveAlgorithm
+}
+
+func keyCurve(key jwk.Key) jwa.EllipticCurveAlgorithm {
+	crvKey, ok := key.(curveKey)
+	if !ok {
+		return jwa.InvalidEllipticCurve
+	}
+
+	return crvKey.Crv()
+}
@@ -0,0 +1,128 @@
+package keys
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestParseAlgorithms(t *testing.T) {
+	var tests = []struct {
+		name  string
+		algs  []string
+		valid bool
+	}{
+		{"DEFAULT", nil, true},
+		{"EDDSA_ES256", []string{"EdDSA", "ES256"}, true},
+		{"NONE", []string{"none"}, false},
+		{"HMAC", []string{"HS256"}, false},
+		{"UNKNOWN", []string{"ES256", "XX999"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAlgorithms(tt.algs)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got err '%v', expected valid: %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCheckKeyAlgorithm(t *testing.T) {
+	setup()
+
+	workdir := t.TempDir()
+	genKey := func(alg jwa.SignatureAlgorithm) jwk.Key {
+		key, err := GenerateSignKeyWithAlg(filepath.Join(workdir, alg.String()+".json"), "utest-"+alg.String(), alg)
+		if err != nil {
+			panic(err)
+		}
+		valKey, err := ToValkey(key)
+		if err != nil {
+			panic(err)
+		}
+		return valKey
+	}
+
+	edKey := genKey(jwa.EdDSA)
+	p256Key := genKey(jwa.ES256)
+	p384Key := genKey(jwa.ES384)
+	rsaKey := genKey(jwa.RS256)
+
+	/* Without "alg" in the JWK only key type and curve can be checked */
+	p384NoAlg, err := p384Key.Clone()
+	if err != nil {
+		panic(err)
+	}
+	err = p384NoAlg.Remove(jwk.AlgorithmKey)
+	if err != nil {
+		panic(err)
+	}
+
+	all := supportedAlgorithms
+	var tests = []struct {
+		name    string
+		key     jwk.Key
+		alg     jwa.SignatureAlgorithm
+		allowed []jwa.SignatureAlgorithm
+		valid   bool
+	}{
+		{"EDDSA", edKey, jwa.EdDSA, all, true},
+		{"ES256", p256Key, jwa.ES256, all, true},
+		{"RS256", rsaKey, jwa.RS256, all, true},
+		{"NOT_ALLOWED", p256Key, jwa.ES256, []jwa.SignatureAlgorithm{jwa.EdDSA}, false},
+		{"KEY_ALG_MISMATCH", rsaKey, jwa.PS256, all, false},
+		{"WRONG_KEY_TYPE", edKey, jwa.ES256, all, false},
+		{"WRONG_CURVE", p384NoAlg, jwa.ES256, all, false},
+		{"NO_KEY_ALG", p384NoAlg, jwa.ES384, all, true},
+		{"HMAC", edKey, jwa.HS256, all, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckKeyAlgorithm(tt.key, tt.alg, tt.allowed)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got err '%v', expected valid: %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestSignVerifyAlgorithms(t *testing.T) {
+	setup()
+
+	workdir := t.TempDir()
+	for _, alg := range []jwa.SignatureAlgorithm{jwa.EdDSA, jwa.ES256, jwa.ES384, jwa.RS256, jwa.PS256} {
+		t.Run(alg.String(), func(t *testing.T) {
+			signKey, err := GenerateSignKeyWithAlg(filepath.Join(workdir, alg.String()+".json"), "utest-sign", alg)
+			if err != nil {
+				panic(err)
+			}
+			valKey, err := ToValkey(signKey)
+			if err != nil {
+				panic(err)
+			}
+
+			signed, err := Sign([]byte(`{"hello":"world"}`), signKey)
+			if err != nil {
+				panic(err)
+			}
+
+			msg, err := ParseSigned(signed)
+			if err != nil {
+				t.Fatalf("error parsing: '%s'", err)
+			}
+			if msg.Algorithm() != alg {
+				t.Fatalf("got algorithm '%s'", msg.Algorithm())
+			}
+
+			_, err = msg.Verify(valKey, []jwa.SignatureAlgorithm{alg})
+			if err != nil {
+				t.Fatalf("error verifying: '%s'", err)
+			}
+		})
+	}
+}
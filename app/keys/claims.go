@@ -0,0 +1,130 @@
+package keys
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+const cCLAIM_IAT = "iat"
+const cCLAIM_EXP = "exp"
+const cCLAIM_JTI = "jti"
+const cJTI_BYTES = 16
+
+/*
+ * Freshness claims carried in the protected header of each signature. Zero
+ * values are not set.
+ */
+type Claims struct {
+	IssuedAt time.Time
+	Expiry   time.Time
+	ID       string
+}
+
+/* Claims for a message signed now, expiring after ttl unless zero */
+func NewClaims(now time.Time, ttl time.Duration) (*Claims, error) {
+	jti := make([]byte, cJTI_BYTES)
+	_, err := rand.Read(jti)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{
+		IssuedAt: now.Truncate(time.Second),
+		ID:       hex.EncodeToString(jti),
+	}
+	if ttl > 0 {
+		claims.Expiry = claims.IssuedAt.Add(ttl)
+	}
+
+	return claims, nil
+}
+
+func (c *Claims) headers() (jws.Headers, error) {
+	hdrs := jws.NewHeaders()
+
+	if !c.IssuedAt.IsZero() {
+		err := hdrs.Set(cCLAIM_IAT, c.IssuedAt.Unix())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.Expiry.IsZero() {
+		err := hdrs.Set(cCLAIM_EXP, c.Expiry.Unix())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ID != "" {
+		err := hdrs.Set(cCLAIM_JTI, c.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hdrs, nil
+}
+
+/* Claims from the protected header of signature i, only trust verified ones */
+func (m *SignedMsg) SignatureClaims(i int) (Claims, error) {
+	var claims Claims
+	protected := m.signatures[i].protected
+
+	iat, err := numericDate(protected, cCLAIM_IAT)
+	if err != nil {
+		return claims, err
+	}
+	claims.IssuedAt = iat
+
+	exp, err := numericDate(protected, cCLAIM_EXP)
+	if err != nil {
+		return claims, err
+	}
+	claims.Expiry = exp
+
+	jti, ok := protected.Get(cCLAIM_JTI)
+	if ok {
+		claims.ID, ok = jti.(string)
+		if !ok || claims.ID == "" {
+			return claims, errors.New("bad jti claim")
+		}
+	}
+
+	return claims, nil
+}
+
+/* Seconds since the epoch (RFC 7519), zero time if not set */
+func numericDate(protected jws.Headers, name string) (time.Time, error) {
+	val, ok := protected.Get(name)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	var secs float64
+	switch v := val.(type) {
+	case float64:
+		secs = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad %s claim", name)
+		}
+		secs = f
+	default:
+		return time.Time{}, fmt.Errorf("bad %s claim", name)
+	}
+
+	if math.IsNaN(secs) || math.IsInf(secs, 0) || secs < 0 {
+		return time.Time{}, fmt.Errorf("bad %s claim", name)
+	}
+
+	return time.Unix(int64(secs), 0), nil
+}
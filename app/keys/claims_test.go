@@ -0,0 +1,80 @@
+package keys
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+func TestSignatureClaims(t *testing.T) {
+	setup()
+
+	workdir := t.TempDir()
+	signKey, err := GenerateSignKey(filepath.Join(workdir, "sign.json"), "utest-claims")
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	claims, err := NewClaims(now, 5*time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	if claims.ID == "" || !claims.Expiry.Equal(now.Add(5*time.Minute)) {
+		t.Fatalf("Bad new claims %+v", claims)
+	}
+
+	badHdrs := jws.NewHeaders()
+	err = badHdrs.Set(cCLAIM_IAT, "yesterday")
+	if err != nil {
+		panic(err)
+	}
+	badIat, err := jws.Sign([]byte(`{}`), jws.WithJSON(), jws.WithKey(signKey.Algorithm(), signKey, jws.WithProtectedHeaders(badHdrs)))
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name   string
+		claims *Claims
+		signed []byte
+		want   Claims
+		valid  bool
+	}{
+		{"ALL", claims, nil, *claims, true},
+		{"IAT_ONLY", &Claims{IssuedAt: now}, nil, Claims{IssuedAt: now}, true},
+		{"NONE", nil, nil, Claims{}, true},
+		{"BAD_IAT", nil, badIat, Claims{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := tt.signed
+			if signed == nil {
+				signed, err = SignWithClaims([]byte(`{}`), signKey, tt.claims)
+				if err != nil {
+					panic(err)
+				}
+			}
+
+			msg, err := ParseSigned(signed)
+			if err != nil {
+				panic(err)
+			}
+
+			got, err := msg.SignatureClaims(0)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error '%v', expected valid: %t", err, tt.valid)
+			}
+			if !tt.valid {
+				return
+			}
+
+			if !got.IssuedAt.Equal(tt.want.IssuedAt) || !got.Expiry.Equal(tt.want.Expiry) || got.ID != tt.want.ID {
+				t.Fatalf("Got claims %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
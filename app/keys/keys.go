@@ -2,12 +2,18 @@ package keys
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/dnstapir/mqtt-bridge/shared"
 
@@ -20,6 +26,10 @@ type SignKey jwk.Key
 type ValKey jwk.Key
 
 const cJWK_ISS_TAG = "iss"
+const cRSA_KEY_BITS = 3072
+
+/* Only b64, which must then be true, see parseSignature */
+var understoodCritical = []string{"b64"}
 
 var log shared.LoggerIF
 
@@ -104,12 +114,77 @@ func GetSignKey(filename string) (SignKey, error) {
 	return keyParsed, nil
 }
 
-func Sign(data []byte, key SignKey) ([]byte, error) {
+/*
+ * Load one or more signing keys from a JWK or JWKS file. Keys in a set must
+ * have distinct key IDs.
+ */
+func GetSignKeys(filename string) ([]SignKey, error) {
 	if log == nil {
 		return nil, errors.New("nil logger")
 	}
 
-	signedData, err := jws.Sign(data, jws.WithJSON(), jws.WithKey(key.Algorithm(), key))
+	keyFile, err := os.ReadFile(filename)
+	if err != nil {
+		log.Error("Could not read signing key file, err: '%s'", err)
+		return nil, err
+	}
+
+	set, err := jwk.Parse(keyFile)
+	if err != nil {
+		log.Error("Could not parse signing key file, err: '%s'", err)
+		return nil, err
+	}
+
+	signKeys := make([]SignKey, 0, set.Len())
+	seen := make(map[string]bool, set.Len())
+	for i := range set.Len() {
+		key, _ := set.Key(i)
+
+		isPrivate, err := jwk.IsPrivateKey(key)
+		if err != nil || !isPrivate {
+			log.Error("Signing key %d in file '%s' is not private", i, filename)
+			return nil, errors.New("signing key must be private")
+		}
+
+		if set.Len() > 1 && (key.KeyID() == "" || seen[key.KeyID()]) {
+			return nil, fmt.Errorf("signing key %d in '%s' has no or a duplicate key id", i, filename)
+		}
+		seen[key.KeyID()] = true
+
+		signKeys = append(signKeys, key)
+	}
+
+	return signKeys, nil
+}
+
+/*
+ * JSON serialization with one signature per key, for key rollovers. Each
+ * signature carries the claims in its protected header, unless nil.
+ */
+func SignAll(data []byte, signKeys []SignKey, claims *Claims) ([]byte, error) {
+	if log == nil {
+		return nil, errors.New("nil logger")
+	}
+
+	if len(signKeys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	opts := []jws.SignOption{jws.WithJSON()}
+	for _, key := range signKeys {
+		var keyOpts []jws.WithKeySuboption
+		if claims != nil {
+			/* Signing sets alg and kid in the headers, so never share them */
+			hdrs, err := claims.headers()
+			if err != nil {
+				return nil, err
+			}
+			keyOpts = append(keyOpts, jws.WithProtectedHeaders(hdrs))
+		}
+		opts = append(opts, jws.WithKey(key.Algorithm(), key, keyOpts...))
+	}
+
+	signedData, err := jws.Sign(data, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -117,48 +192,205 @@ func Sign(data []byte, key SignKey) ([]byte, error) {
 	return signedData, nil
 }
 
-func GetKeyIDFromSignedData(sig []byte) (string, error) {
+func Sign(data []byte, key SignKey) ([]byte, error) {
+	return SignWithClaims(data, key, nil)
+}
+
+func SignWithClaims(data []byte, key SignKey, claims *Claims) ([]byte, error) {
+	return SignAll(data, []SignKey{key}, claims)
+}
+
+/*
+ * A JWS message in JSON serialization, parsed once so that the key ID can be
+ * looked up before the signature is verified against the resolved key
+ */
+type SignedMsg struct {
+	payload    []byte
+	payloadEnc string
+	signatures []signature
+}
+
+type signature struct {
+	protected    jws.Headers
+	protectedEnc string
+	sig          []byte
+}
+
+type jsonSignature struct {
+	Protected string `json:"protected"`
+	Signature string `json:"signature"`
+}
+
+type jsonMsg struct {
+	Payload    string          `json:"payload"`
+	Signatures []jsonSignature `json:"signatures"`
+	jsonSignature
+}
+
+func ParseSigned(data []byte) (*SignedMsg, error) {
 	if log == nil {
-		return "", errors.New("nil logger")
+		return nil, errors.New("nil logger")
 	}
 
-	jwsMsg, err := jws.Parse(sig, jws.WithJSON())
+	var raw jsonMsg
+	err := json.Unmarshal(data, &raw)
 	if err != nil {
-		log.Error("Malformed JWS message '%s'. Discarding...", string(sig))
-		return "", err
+		log.Error("Malformed JWS message '%s'. Discarding...", string(data))
+		return nil, err
 	}
 
-	sigs := jwsMsg.Signatures()
-	if len(sigs) > 1 {
-		log.Warning("JWS message contains multiple signatures. Only one will be used")
-	} else if len(sigs) == 0 {
+	rawSigs := raw.Signatures
+	if len(rawSigs) == 0 && raw.Signature != "" {
+		rawSigs = []jsonSignature{raw.jsonSignature}
+	} else if len(rawSigs) > 0 && raw.Signature != "" {
+		return nil, errors.New("both flattened and general serialization used")
+	}
+
+	if len(rawSigs) == 0 {
 		log.Error("JWS message contained no signatures. Discarding...")
-		return "", errors.New("message contained no signatures")
+		return nil, errors.New("message contained no signatures")
 	}
 
-	jwsKid := sigs[0].ProtectedHeaders().KeyID()
-	if jwsKid == "" {
+	payload, err := base64.RawURLEncoding.DecodeString(raw.Payload)
+	if err != nil {
+		return nil, errors.New("error decoding payload")
+	}
+
+	msg := &SignedMsg{
+		payload:    payload,
+		payloadEnc: raw.Payload,
+		signatures: make([]signature, 0, len(rawSigs)),
+	}
+
+	for _, rawSig := range rawSigs {
+		sig, err := parseSignature(rawSig)
+		if err != nil {
+			log.Error("Malformed JWS signature, err: '%s'. Discarding...", err)
+			return nil, err
+		}
+		msg.signatures = append(msg.signatures, sig)
+	}
+
+	if msg.KeyID() == "" {
 		log.Error("Incoming JWS had no \"kid\" set. Discarding...")
-		return "", errors.New("key id not found")
+		return nil, errors.New("key id not found")
 	}
 
-	return jwsKid, nil
+	return msg, nil
 }
 
-func CheckSignature(sig []byte, key ValKey) ([]byte, error) {
+func parseSignature(rawSig jsonSignature) (signature, error) {
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(rawSig.Protected)
+	if err != nil {
+		return signature{}, errors.New("error decoding protected header")
+	}
+
+	protected := jws.NewHeaders()
+	err = json.Unmarshal(protectedJSON, protected)
+	if err != nil {
+		return signature{}, errors.New("error parsing protected header")
+	}
+
+	/* Unencoded payloads (RFC 7797) are never produced by any bridge */
+	b64, ok := protected.Get("b64")
+	if ok && b64 != true {
+		return signature{}, errors.New("unencoded payload not supported")
+	}
+
+	/* Critical extensions must be understood (RFC 7515 section 4.1.11) */
+	_, ok = protected.Get(jws.CriticalKey)
+	if ok && len(protected.Critical()) == 0 {
+		return signature{}, errors.New("empty crit header")
+	}
+	for _, name := range protected.Critical() {
+		if !slices.Contains(understoodCritical, name) {
+			return signature{}, fmt.Errorf("unsupported critical header '%s'", name)
+		}
+		_, ok := protected.Get(name)
+		if !ok {
+			return signature{}, fmt.Errorf("critical header '%s' missing", name)
+		}
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(rawSig.Signature)
+	if err != nil {
+		return signature{}, errors.New("error decoding signature")
+	}
+
+	return signature{
+		protected:    protected,
+		protectedEnc: rawSig.Protected,
+		sig:          sig,
+	}, nil
+}
+
+/* Key ID of the first signature, always set */
+func (m *SignedMsg) KeyID() string {
+	return m.signatures[0].protected.KeyID()
+}
+
+func (m *SignedMsg) NumSignatures() int {
+	return len(m.signatures)
+}
+
+func (m *SignedMsg) SignatureKeyID(i int) string {
+	return m.signatures[i].protected.KeyID()
+}
+
+func (m *SignedMsg) Algorithm() jwa.SignatureAlgorithm {
+	return m.signatures[0].protected.Algorithm()
+}
+
+func (m *SignedMsg) ProtectedHeaders() jws.Headers {
+	return m.signatures[0].protected
+}
+
+func (m *SignedMsg) Verify(key ValKey, allowed []jwa.SignatureAlgorithm) ([]byte, error) {
+	return m.VerifySignature(0, key, allowed)
+}
+
+/*
+ * Verify against the original encoded header and payload, no re-parsing. The
+ * algorithm in the protected header must be allowed and fit the key.
+ */
+func (m *SignedMsg) VerifySignature(i int, key ValKey, allowed []jwa.SignatureAlgorithm) ([]byte, error) {
 	if log == nil {
 		return nil, errors.New("nil logger")
 	}
 
-	data, err := jws.Verify(sig, jws.WithJSON(), jws.WithKey(key.Algorithm(), key))
+	sig := m.signatures[i]
+	alg := sig.protected.Algorithm()
+	err := CheckKeyAlgorithm(key, alg, allowed)
 	if err != nil {
-		log.Error("Failed to verify signature on message. Discarding...")
+		log.Warning("Rejected algorithm for key '%s', err: '%s'", key.KeyID(), err)
+		return nil, err
+	}
+
+	verifier, err := jws.NewVerifier(alg)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := []byte(sig.protectedEnc + "." + m.payloadEnc)
+
+	err = verifier.Verify(signingInput, sig.sig, key)
+	if err != nil {
+		log.Warning("Failed to verify signature with key '%s'", key.KeyID())
 		return nil, err
 	}
 
 	log.Debug("Message signature was successfully validated! Used key '%s'", key.KeyID())
 
-	return data, nil
+	return m.payload, nil
+}
+
+func CheckSignature(sig []byte, key ValKey) ([]byte, error) {
+	msg, err := ParseSigned(sig)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Verify(key, supportedAlgorithms)
 }
 
 func ToValkey(signKey SignKey) (ValKey, error) {
@@ -171,11 +403,15 @@ func ToValkey(signKey SignKey) (ValKey, error) {
 }
 
 func GenerateValKey(filename, kid string) (ValKey, error) {
-	return generateKey(filename, kid, false)
+	return generateKey(filename, kid, jwa.EdDSA, false)
 }
 
 func GenerateSignKey(filename, kid string) (SignKey, error) {
-	return generateKey(filename, kid, true)
+	return generateKey(filename, kid, jwa.EdDSA, true)
+}
+
+func GenerateSignKeyWithAlg(filename, kid string, alg jwa.SignatureAlgorithm) (SignKey, error) {
+	return generateKey(filename, kid, alg, true)
 }
 
 func GetThumbprint(key ValKey) string {
@@ -194,12 +430,12 @@ func getThumbprint(key jwk.Key) string {
 	return thumbprintEnc
 }
 
-func generateKey(filename, kid string, isPrivate bool) (jwk.Key, error) {
+func generateKey(filename, kid string, alg jwa.SignatureAlgorithm, isPrivate bool) (jwk.Key, error) {
 	if log == nil {
 		return nil, errors.New("nil logger")
 	}
 
-	_, dataKeyRaw, err := ed25519.GenerateKey(nil)
+	dataKeyRaw, err := generateRawKey(alg)
 	if err != nil {
 		return nil, err
 	}
@@ -214,7 +450,7 @@ func generateKey(filename, kid string, isPrivate bool) (jwk.Key, error) {
 		return nil, err
 	}
 
-	err = dataKeyJWK.Set(jwk.AlgorithmKey, jwa.EdDSA)
+	err = dataKeyJWK.Set(jwk.AlgorithmKey, alg)
 	if err != nil {
 		return nil, err
 	}
@@ -246,3 +482,21 @@ func generateKey(filename, kid string, isPrivate bool) (jwk.Key, error) {
 
 	return dataKeyOut, nil
 }
+
+func generateRawKey(alg jwa.SignatureAlgorithm) (crypto.Signer, error) {
+	switch alg {
+	case jwa.EdDSA:
+		_, key, err := ed25519.GenerateKey(nil)
+		return key, err
+	case jwa.ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwa.ES384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jwa.ES512:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jwa.RS256, jwa.RS384, jwa.RS512, jwa.PS256, jwa.PS384, jwa.PS512:
+		return rsa.GenerateKey(rand.Reader, cRSA_KEY_BITS)
+	}
+
+	return nil, fmt.Errorf("cannot generate key for algorithm '%s'", alg)
+}
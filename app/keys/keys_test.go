@@ -1,12 +1,15 @@
 package keys
 
 import (
+	"bytes"
 	"path/filepath"
 	"testing"
 
 	"github.com/dnstapir/mqtt-bridge/inject/fake"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 )
 
 func setup() {
@@ -35,3 +38,95 @@ func TestGenerateSignKey(t *testing.T) {
 		t.Fatalf("Keys have different thumbprints")
 	}
 }
+
+func TestParseSignedVerify(t *testing.T) {
+	/* The fake logger panics on errors, which rejected messages are expected to log */
+	err := SetLogger(fake.QuietLogger())
+	if err != nil {
+		panic(err)
+	}
+	defer setup()
+
+	workdir := t.TempDir()
+	signKey, err := GenerateSignKey(filepath.Join(workdir, "sign.json"), "utest-sign")
+	if err != nil {
+		panic(err)
+	}
+	otherKey, err := GenerateSignKey(filepath.Join(workdir, "other.json"), "utest-sign")
+	if err != nil {
+		panic(err)
+	}
+	valKey, err := ToValkey(signKey)
+	if err != nil {
+		panic(err)
+	}
+
+	payload := []byte(`{"hello":"world"}`)
+	signed, err := Sign(payload, signKey)
+	if err != nil {
+		panic(err)
+	}
+	forged, err := Sign(payload, otherKey)
+	if err != nil {
+		panic(err)
+	}
+
+	signWithHeaders := func(hdrs map[string]any) []byte {
+		protected := jws.NewHeaders()
+		for name, val := range hdrs {
+			err := protected.Set(name, val)
+			if err != nil {
+				panic(err)
+			}
+		}
+		signed, err := jws.Sign(payload, jws.WithJSON(), jws.WithKey(jwa.EdDSA, signKey, jws.WithProtectedHeaders(protected)))
+		if err != nil {
+			panic(err)
+		}
+		return signed
+	}
+	critUnknown := signWithHeaders(map[string]any{jws.CriticalKey: []string{"x-ext"}, "x-ext": 1})
+	critB64 := signWithHeaders(map[string]any{jws.CriticalKey: []string{"b64"}, "b64": true})
+
+	var tests = []struct {
+		name  string
+		input []byte
+		parse bool
+		valid bool
+	}{
+		{"OK", signed, true, true},
+		{"CRIT_UNKNOWN", critUnknown, false, false},
+		{"CRIT_B64", critB64, true, true},
+		{"OTHER_KEY", forged, true, false},
+		{"TAMPERED", bytes.Replace(signed, []byte(`"payload":"`), []byte(`"payload":"x`), 1), true, false},
+		{"NOT_JSON", []byte("abc.def.ghi"), false, false},
+		{"NO_SIGNATURES", []byte(`{"payload":"e30"}`), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseSigned(tt.input)
+			if (err == nil) != tt.parse {
+				t.Fatalf("parse error: '%v', expected parse ok: %t", err, tt.parse)
+			}
+			if err != nil {
+				return
+			}
+
+			if msg.KeyID() != "utest-sign" {
+				t.Fatalf("got key id '%s'", msg.KeyID())
+			}
+			if msg.Algorithm() != jwa.EdDSA {
+				t.Fatalf("got algorithm '%s'", msg.Algorithm())
+			}
+
+			data, err := msg.Verify(valKey, supportedAlgorithms)
+			if (err == nil) != tt.valid {
+				t.Fatalf("verify error: '%v', expected valid: %t", err, tt.valid)
+			}
+			if err == nil && !bytes.Equal(data, payload) {
+				t.Fatalf("got payload '%s'", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const cKEYDIR_SUFFIX = ".json"
+
+/*
+ * Load validation keys from a single JWK file, a JWKS file or a directory of
+ * "<kid>.json" files. Private keys are reduced to their public part.
+ */
+func LoadValKeys(path string) ([]ValKey, error) {
+	if log == nil {
+		return nil, errors.New("nil logger")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New("error reading validation key path")
+	}
+
+	if info.IsDir() {
+		return loadKeyDir(path)
+	}
+
+	return loadKeyFile(path)
+}
+
+func loadKeyFile(filename string) ([]ValKey, error) {
+	keyFile, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("error reading validation key file")
+	}
+
+	set, err := jwk.Parse(keyFile)
+	if err != nil {
+		return nil, errors.New("error parsing validation key file")
+	}
+
+	valKeys := make([]ValKey, 0, set.Len())
+	seen := make(map[string]bool, set.Len())
+	for i := range set.Len() {
+		key, _ := set.Key(i)
+
+		if set.Len() > 1 && (key.KeyID() == "" || seen[key.KeyID()]) {
+			return nil, fmt.Errorf("key %d in key set '%s' has no or a duplicate key id", i, filename)
+		}
+		seen[key.KeyID()] = true
+
+		valKey, err := ToValkey(key)
+		if err != nil {
+			return nil, errors.New("error getting validation key from signing key")
+		}
+		valKeys = append(valKeys, valKey)
+	}
+
+	return valKeys, nil
+}
+
+/* Files not named after the key ID they contain are skipped */
+func loadKeyDir(dirname string) ([]ValKey, error) {
+	entries, err := os.ReadDir(dirname)
+	if err != nil {
+		return nil, errors.New("error reading validation key directory")
+	}
+
+	valKeys := make([]ValKey, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), cKEYDIR_SUFFIX) {
+			continue
+		}
+
+		filename := filepath.Join(dirname, e.Name())
+		keyID := strings.TrimSuffix(e.Name(), cKEYDIR_SUFFIX)
+
+		keyFile, err := os.ReadFile(filename)
+		if err != nil {
+			log.Warning("Could not read key file '%s', err: '%s'", filename, err)
+			continue
+		}
+
+		key, err := jwk.ParseKey(keyFile)
+		if err != nil {
+			log.Warning("Could not parse key file '%s', err: '%s'", filename, err)
+			continue
+		}
+
+		if key.KeyID() != keyID {
+			log.Warning("Key ID '%s' in '%s' does not match file name, skipping", key.KeyID(), filename)
+			continue
+		}
+
+		valKey, err := ToValkey(key)
+		if err != nil {
+			log.Warning("Could not get validation key from '%s', err: '%s'", filename, err)
+			continue
+		}
+		valKeys = append(valKeys, valKey)
+	}
+
+	return valKeys, nil
+}
+
+/*
+ * A string that changes whenever a key file, or any key file in a key
+ * directory, is added, removed or modified
+ */
+func KeySourceVersion(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return fileVersion(info), nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return "", err
+	}
+
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), cKEYDIR_SUFFIX) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, e.Name()+":"+fileVersion(info))
+	}
+	sort.Strings(versions)
+
+	return strings.Join(versions, ","), nil
+}
+
+func fileVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
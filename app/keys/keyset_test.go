@@ -0,0 +1,154 @@
+package keys
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+func TestLoadValKeys(t *testing.T) {
+	setup()
+
+	workdir := t.TempDir()
+	keydir := filepath.Join(workdir, "keydir")
+	err := os.Mkdir(keydir, 0750)
+	if err != nil {
+		panic(err)
+	}
+
+	set := jwk.NewSet()
+	for _, kid := range []string{"node-a", "node-b", "node-c"} {
+		key, err := GenerateSignKey(filepath.Join(keydir, kid+".json"), kid)
+		if err != nil {
+			panic(err)
+		}
+		err = set.AddKey(key)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	/* Mismatching file names and other files are skipped */
+	_, err = GenerateValKey(filepath.Join(keydir, "wrong-name.json"), "node-d")
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(filepath.Join(keydir, "README"), []byte("not a key"), 0640)
+	if err != nil {
+		panic(err)
+	}
+
+	setJSON, err := json.Marshal(set)
+	if err != nil {
+		panic(err)
+	}
+	jwksfile := filepath.Join(workdir, "keys.jwks")
+	err = os.WriteFile(jwksfile, setJSON, 0640)
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"SINGLE", filepath.Join(keydir, "node-a.json"), []string{"node-a"}},
+		{"JWKS", jwksfile, []string{"node-a", "node-b", "node-c"}},
+		{"DIRECTORY", keydir, []string{"node-a", "node-b", "node-c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valKeys, err := LoadValKeys(tt.path)
+			if err != nil {
+				t.Fatalf("error loading keys: '%s'", err)
+			}
+
+			got := make([]string, 0, len(valKeys))
+			for _, key := range valKeys {
+				isPrivate, _ := jwk.IsPrivateKey(key)
+				if isPrivate {
+					t.Fatalf("key '%s' is private", key.KeyID())
+				}
+				got = append(got, key.KeyID())
+			}
+			sort.Strings(got)
+
+			if len(got) != len(tt.expected) {
+				t.Fatalf("got keys %v, expected %v", got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Fatalf("got keys %v, expected %v", got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadValKeysDuplicateKeyID(t *testing.T) {
+	setup()
+
+	workdir := t.TempDir()
+
+	set := jwk.NewSet()
+	for _, name := range []string{"first.json", "second.json"} {
+		key, err := GenerateValKey(filepath.Join(workdir, name), "node-a")
+		if err != nil {
+			panic(err)
+		}
+		err = set.AddKey(key)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	setJSON, err := json.Marshal(set)
+	if err != nil {
+		panic(err)
+	}
+	jwksfile := filepath.Join(workdir, "keys.jwks")
+	err = os.WriteFile(jwksfile, setJSON, 0640)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = LoadValKeys(jwksfile)
+	if err == nil {
+		t.Fatalf("loaded key set with duplicate key ids")
+	}
+}
+
+func TestKeySourceVersion(t *testing.T) {
+	setup()
+
+	keydir := t.TempDir()
+	_, err := GenerateValKey(filepath.Join(keydir, "node-a.json"), "node-a")
+	if err != nil {
+		panic(err)
+	}
+
+	before, err := KeySourceVersion(keydir)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = GenerateValKey(filepath.Join(keydir, "node-b.json"), "node-b")
+	if err != nil {
+		panic(err)
+	}
+
+	after, err := KeySourceVersion(keydir)
+	if err != nil {
+		panic(err)
+	}
+
+	if before == after {
+		t.Fatalf("version unchanged after adding key")
+	}
+}
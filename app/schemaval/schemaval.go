@@ -72,21 +72,21 @@ func Create(conf Conf) (*Schemaval, error) {
 	return newSchemaval, nil
 }
 
-func (s *Schemaval) Validate(data []byte) bool {
+func (s *Schemaval) Validate(data []byte) error {
 	dataReader := bytes.NewReader(data)
 	obj, err := jsonschema.UnmarshalJSON(dataReader)
 	if err != nil {
 		s.log.Error("Error unmarshalling byte stream into JSON object")
-		return false
+		return err
 	}
 
 	err = s.schema.Validate(obj)
 	if err != nil {
 		s.log.Debug("Validation error '%s'", err)
-		return false
+		return err
 	}
 
-	return true
+	return nil
 }
 
 func (s *Schemaval) GetID() string {
@@ -0,0 +1,203 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Templates for NATS subjects and MQTT topics, filled in per message.
+ * Supported placeholders:
+ *
+ *   {kid}        key ID of the verified signer (NATS subjects only)
+ *   {topic[N]}   level N (zero-based) of the MQTT topic (NATS subjects only)
+ *   {subject[N]} token N (zero-based) of the NATS subject (MQTT topics only)
+ *
+ * NATS subjects are only templated on up bridges and MQTT topics on down
+ * bridges, other placeholders would have no value and are rejected.
+ *
+ * Values are escaped so that they always form a valid part of a single
+ * subject token or topic level. Characters that are not allowed are replaced
+ * by '%' followed by two uppercase hex digits, and '%' itself is escaped as
+ * "%25". Empty values cannot be represented and result in an error.
+ */
+
+const cVAR_KID = "kid"
+const cVAR_TOPIC = "topic"
+const cVAR_SUBJECT = "subject"
+
+type Vars struct {
+	KeyID   string
+	Topic   []string
+	Subject []string
+}
+
+type Template struct {
+	raw    string
+	parts  []part
+	escape func(string) string
+}
+
+type part struct {
+	literal string
+	name    string
+	index   int
+}
+
+func ForNatsSubject(tmpl string) (*Template, error) {
+	return parse(tmpl, EscapeNatsToken, cVAR_KID, cVAR_TOPIC)
+}
+
+func ForMqttTopic(tmpl string) (*Template, error) {
+	return parse(tmpl, EscapeMqttLevel, cVAR_SUBJECT)
+}
+
+func (t *Template) IsStatic() bool {
+	for _, p := range t.parts {
+		if p.name != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *Template) String() string {
+	return t.raw
+}
+
+func (t *Template) Execute(vars Vars) (string, error) {
+	var sb strings.Builder
+
+	for _, p := range t.parts {
+		if p.name == "" {
+			sb.WriteString(p.literal)
+			continue
+		}
+
+		var val string
+		switch p.name {
+		case cVAR_KID:
+			val = vars.KeyID
+		case cVAR_TOPIC:
+			if p.index >= len(vars.Topic) {
+				return "", fmt.Errorf("topic level %d out of range", p.index)
+			}
+			val = vars.Topic[p.index]
+		case cVAR_SUBJECT:
+			if p.index >= len(vars.Subject) {
+				return "", fmt.Errorf("subject token %d out of range", p.index)
+			}
+			val = vars.Subject[p.index]
+		}
+
+		if val == "" {
+			return "", fmt.Errorf("empty value for placeholder '%s'", p.literal)
+		}
+
+		sb.WriteString(t.escape(val))
+	}
+
+	return sb.String(), nil
+}
+
+/* Escape value for use in a NATS subject token */
+func EscapeNatsToken(val string) string {
+	return escape(val, func(b byte) bool {
+		return b == '.' || b == '*' || b == '>'
+	})
+}
+
+/* Escape value for use in an MQTT topic level */
+func EscapeMqttLevel(val string) string {
+	return escape(val, func(b byte) bool {
+		return b == '/' || b == '+' || b == '#'
+	})
+}
+
+func escape(val string, special func(byte) bool) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(val); i++ {
+		b := val[i]
+		if b == '%' || b <= ' ' || b == 0x7f || special(b) {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+
+	return sb.String()
+}
+
+func parse(tmpl string, escape func(string) string, allowed ...string) (*Template, error) {
+	newTemplate := new(Template)
+	newTemplate.raw = tmpl
+	newTemplate.escape = escape
+
+	rest := tmpl
+	for rest != "" {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			if strings.IndexByte(rest, '}') != -1 {
+				return nil, errors.New("unbalanced '}' in template")
+			}
+			newTemplate.parts = append(newTemplate.parts, part{literal: rest})
+			break
+		}
+
+		if start > 0 {
+			if strings.IndexByte(rest[:start], '}') != -1 {
+				return nil, errors.New("unbalanced '}' in template")
+			}
+			newTemplate.parts = append(newTemplate.parts, part{literal: rest[:start]})
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end == -1 {
+			return nil, errors.New("unterminated placeholder in template")
+		}
+		end += start
+
+		p, err := parsePlaceholder(rest[start : end+1])
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(allowed, p.name) {
+			return nil, fmt.Errorf("placeholder '%s' not available in this template", p.literal)
+		}
+		newTemplate.parts = append(newTemplate.parts, p)
+
+		rest = rest[end+1:]
+	}
+
+	return newTemplate, nil
+}
+
+func parsePlaceholder(placeholder string) (part, error) {
+	inner := placeholder[1 : len(placeholder)-1]
+
+	if inner == cVAR_KID {
+		return part{literal: placeholder, name: cVAR_KID}, nil
+	}
+
+	open := strings.IndexByte(inner, '[')
+	if open == -1 || !strings.HasSuffix(inner, "]") {
+		return part{}, fmt.Errorf("unknown placeholder '%s'", placeholder)
+	}
+
+	name := inner[:open]
+	if name != cVAR_TOPIC && name != cVAR_SUBJECT {
+		return part{}, fmt.Errorf("unknown placeholder '%s'", placeholder)
+	}
+
+	index, err := strconv.Atoi(inner[open+1 : len(inner)-1])
+	if err != nil || index < 0 {
+		return part{}, fmt.Errorf("bad index in placeholder '%s'", placeholder)
+	}
+
+	return part{literal: placeholder, name: name, index: index}, nil
+}
@@ -0,0 +1,92 @@
+package templates
+
+import (
+	"testing"
+)
+
+func TestNatsSubjectTemplate(t *testing.T) {
+	var tests = []struct {
+		name        string
+		tmpl        string
+		vars        Vars
+		expected    string
+		expectedErr bool
+	}{
+		{"STATIC", "events.up.some_event", Vars{}, "events.up.some_event", false},
+		{"KID", "events.up.{kid}", Vars{KeyID: "node1"}, "events.up.node1", false},
+		{"TOPIC", "events.up.{topic[2]}.{kid}", Vars{KeyID: "node1", Topic: []string{"events", "up", "dns"}}, "events.up.dns.node1", false},
+		{"ESCAPE_DOT", "events.up.{kid}", Vars{KeyID: "node.1"}, "events.up.node%2E1", false},
+		{"ESCAPE_SPACE", "events.up.{kid}", Vars{KeyID: "node 1"}, "events.up.node%201", false},
+		{"ESCAPE_WILDCARDS", "events.up.{kid}", Vars{KeyID: "*>"}, "events.up.%2A%3E", false},
+		{"ESCAPE_PERCENT", "events.up.{kid}", Vars{KeyID: "100%"}, "events.up.100%25", false},
+		{"NO_ESCAPE_SLASH", "events.up.{kid}", Vars{KeyID: "a/b"}, "events.up.a/b", false},
+		{"OUT_OF_RANGE", "events.up.{topic[5]}", Vars{Topic: []string{"events"}}, "", true},
+		{"EMPTY_VALUE", "events.up.{topic[1]}", Vars{Topic: []string{"events", ""}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ForNatsSubject(tt.tmpl)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %s", err)
+			}
+			got, err := tmpl.Execute(tt.vars)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error, got '%s'", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("got %s, expected %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTemplateParseErrors(t *testing.T) {
+	var tests = []struct {
+		name string
+		tmpl string
+	}{
+		{"UNTERMINATED", "events.up.{kid"},
+		{"UNBALANCED", "events.up.kid}"},
+		{"UNKNOWN", "events.up.{foo}"},
+		{"BAD_INDEX", "events.up.{topic[x]}"},
+		{"NEGATIVE_INDEX", "events.up.{topic[-1]}"},
+		{"SUBJECT_IN_SUBJECT", "events.up.{subject[1]}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ForNatsSubject(tt.tmpl)
+			if err == nil {
+				t.Fatalf("expected error for template '%s'", tt.tmpl)
+			}
+		})
+	}
+}
+
+func TestMqttTopicPlaceholders(t *testing.T) {
+	var tests = []struct {
+		name  string
+		tmpl  string
+		valid bool
+	}{
+		{"SUBJECT", "observations/down/{subject[2]}", true},
+		{"TOPIC", "observations/down/{topic[2]}", false},
+		{"KID", "observations/down/{kid}", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ForMqttTopic(tt.tmpl)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error '%v', expected valid: %t", err, tt.valid)
+			}
+		})
+	}
+}
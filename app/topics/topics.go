@@ -0,0 +1,82 @@
+package topics
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+ * Placeholder for the key ID of the signer in an MQTT topic pattern, e.g.
+ * "events/up/{kid}/#". The placeholder must make up a whole topic level and
+ * is subscribed to as a single level wildcard.
+ */
+const cPLACEHOLDER_KID = "{kid}"
+const cSHARED_SUB_PREFIX = "$share/"
+
+type Pattern struct {
+	filter   string
+	kidLevel int
+}
+
+func ParsePattern(pattern string) (*Pattern, error) {
+	newPattern := new(Pattern)
+	newPattern.kidLevel = -1
+
+	if pattern == "" {
+		return nil, errors.New("empty topic pattern")
+	}
+
+	prefix := ""
+	topic := pattern
+	if strings.HasPrefix(pattern, cSHARED_SUB_PREFIX) {
+		parts := strings.SplitN(pattern, "/", 3)
+		if len(parts) != 3 {
+			return nil, errors.New("malformed shared subscription")
+		}
+		prefix = parts[0] + "/" + parts[1] + "/"
+		topic = parts[2]
+	}
+
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		if l == cPLACEHOLDER_KID {
+			if newPattern.kidLevel != -1 {
+				return nil, errors.New("key id placeholder used more than once")
+			}
+			newPattern.kidLevel = i
+			levels[i] = "+"
+		} else if strings.Contains(l, cPLACEHOLDER_KID) {
+			return nil, errors.New("key id placeholder must be a whole topic level")
+		}
+	}
+
+	newPattern.filter = prefix + strings.Join(levels, "/")
+
+	return newPattern, nil
+}
+
+/* Topic filter to use when subscribing */
+func (p *Pattern) Filter() string {
+	return p.filter
+}
+
+func (p *Pattern) IsKeyBound() bool {
+	return p.kidLevel != -1
+}
+
+/*
+ * Extract the key ID from a topic received on the subscription. Returns false
+ * if the pattern is not key bound or the topic is too short to hold it.
+ */
+func (p *Pattern) KeyIDFromTopic(topic string) (string, bool) {
+	if !p.IsKeyBound() {
+		return "", false
+	}
+
+	levels := strings.Split(topic, "/")
+	if p.kidLevel >= len(levels) {
+		return "", false
+	}
+
+	return levels[p.kidLevel], true
+}
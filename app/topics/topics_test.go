@@ -0,0 +1,73 @@
+package topics
+
+import (
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	var tests = []struct {
+		name           string
+		pattern        string
+		expectedFilter string
+		expectedBound  bool
+		expectedErr    bool
+	}{
+		{"STATIC", "events/up/node1", "events/up/node1", false, false},
+		{"KID", "events/up/{kid}", "events/up/+", true, false},
+		{"KID_HASH", "events/up/{kid}/#", "events/up/+/#", true, false},
+		{"KID_SHARED", "$share/grp/events/up/{kid}", "$share/grp/events/up/+", true, false},
+		{"KID_TWICE", "events/{kid}/{kid}", "", false, true},
+		{"KID_PARTIAL", "events/up/node-{kid}", "", false, true},
+		{"EMPTY", "", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePattern(tt.pattern)
+			if tt.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error for pattern '%s'", tt.pattern)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if p.Filter() != tt.expectedFilter {
+				t.Fatalf("got filter %s, expected %s", p.Filter(), tt.expectedFilter)
+			}
+			if p.IsKeyBound() != tt.expectedBound {
+				t.Fatalf("got bound %t, expected %t", p.IsKeyBound(), tt.expectedBound)
+			}
+		})
+	}
+}
+
+func TestKeyIDFromTopic(t *testing.T) {
+	var tests = []struct {
+		name       string
+		pattern    string
+		topic      string
+		expectedID string
+		expectedOk bool
+	}{
+		{"UNBOUND", "events/up/node1", "events/up/node1", "", false},
+		{"BOUND", "events/up/{kid}", "events/up/node1", "node1", true},
+		{"BOUND_DEEP", "events/up/{kid}/#", "events/up/node1/type/x", "node1", true},
+		{"BOUND_SHARED", "$share/grp/events/up/{kid}", "events/up/node1", "node1", true},
+		{"TOO_SHORT", "events/up/{kid}", "events/up", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParsePattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got, ok := p.KeyIDFromTopic(tt.topic)
+			if got != tt.expectedID || ok != tt.expectedOk {
+				t.Fatalf("got (%s, %t), expected (%s, %t)", got, ok, tt.expectedID, tt.expectedOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package upbridge
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/shared"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+const cDEDUP_SIZE = 10000
+
+/* Log every n:th duplicate to avoid flooding the log, like dropped messages */
+const cDEDUP_LOG_INTERVAL = 1000
+
+/*
+ * Suppresses messages seen within a window, bounded both in time and number
+ * of messages. Messages are identified by the hash of the signed message or,
+ * if configured, by a top level field of the payload per sender.
+ */
+type deduper struct {
+	log        shared.LoggerIF
+	field      string
+	mu         sync.Mutex
+	seen       *expirable.LRU[string, struct{}]
+	duplicates atomic.Uint64
+}
+
+/* Nil if not configured */
+func newDeduper(log shared.LoggerIF, window time.Duration, size int, field string) (*deduper, error) {
+	if window < 0 || size < 0 {
+		return nil, errors.New("bad dedup window")
+	}
+
+	if window == 0 && size == 0 {
+		if field != "" {
+			return nil, errors.New("dedup field needs a window or size")
+		}
+		return nil, nil
+	}
+
+	if size == 0 {
+		size = cDEDUP_SIZE
+	}
+
+	d := &deduper{
+		log:   log,
+		field: field,
+		seen:  expirable.NewLRU[string, struct{}](size, nil, window),
+	}
+
+	return d, nil
+}
+
+/* Returns true, and counts it, if the message was seen before */
+func (d *deduper) duplicate(keyID, msgHash string, payload []byte) bool {
+	id, ok := d.messageID(keyID, msgHash, payload)
+	if !ok {
+		return false
+	}
+
+	d.mu.Lock()
+	seen := d.seen.Contains(id)
+	if !seen {
+		d.seen.Add(id, struct{}{})
+	}
+	d.mu.Unlock()
+
+	if !seen {
+		return false
+	}
+
+	n := d.duplicates.Add(1)
+	if n == 1 || n%cDEDUP_LOG_INTERVAL == 0 {
+		d.log.Warning("Dropped duplicate message from '%s', %d dropped in total", keyID, n)
+	} else {
+		d.log.Debug("Dropped duplicate message from '%s', %d dropped in total", keyID, n)
+	}
+
+	return true
+}
+
+func (d *deduper) Duplicates() uint64 {
+	return d.duplicates.Load()
+}
+
+/* Messages without the field are never considered duplicates */
+func (d *deduper) messageID(keyID, msgHash string, payload []byte) (string, bool) {
+	if d.field == "" {
+		return msgHash, true
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return "", false
+	}
+
+	val, ok := fields[d.field]
+	if !ok {
+		d.log.Debug("No field '%s' in message from '%s', not deduplicated", d.field, keyID)
+		return "", false
+	}
+
+	return keyID + "\x00" + string(val), true
+}
@@ -0,0 +1,48 @@
+package upbridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+)
+
+func TestDeduperDuplicate(t *testing.T) {
+	type msg struct {
+		keyID   string
+		hash    string
+		payload string
+	}
+
+	var tests = []struct {
+		name  string
+		size  int
+		field string
+		msgs  []msg
+		want  uint64
+	}{
+		{"DISTINCT_HASH", 0, "", []msg{{"a", "h1", "{}"}, {"a", "h2", "{}"}}, 0},
+		{"SAME_HASH", 0, "", []msg{{"a", "h1", "{}"}, {"b", "h1", "{}"}}, 1},
+		{"EVICTED", 1, "", []msg{{"a", "h1", "{}"}, {"a", "h2", "{}"}, {"a", "h1", "{}"}}, 0},
+		{"SAME_FIELD", 0, "message_id", []msg{{"a", "h1", `{"message_id":"1"}`}, {"a", "h2", `{"message_id":"1","x":1}`}}, 1},
+		{"FIELD_PER_SENDER", 0, "message_id", []msg{{"a", "h1", `{"message_id":"1"}`}, {"b", "h2", `{"message_id":"1"}`}}, 0},
+		{"NO_FIELD", 0, "message_id", []msg{{"a", "h1", `{}`}, {"a", "h1", `{}`}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDeduper(fake.Logger(), time.Minute, tt.size, tt.field)
+			if err != nil {
+				t.Fatalf("Error creating deduper: %s", err)
+			}
+
+			for _, m := range tt.msgs {
+				d.duplicate(m.keyID, m.hash, []byte(m.payload))
+			}
+
+			if d.Duplicates() != tt.want {
+				t.Fatalf("Got %d duplicates, expected %d", d.Duplicates(), tt.want)
+			}
+		})
+	}
+}
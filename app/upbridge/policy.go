@@ -0,0 +1,101 @@
+package upbridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	POLICY_FIRST     = "first"
+	POLICY_ANY       = "any"
+	POLICY_ALL       = "all"
+	POLICY_THRESHOLD = "threshold"
+)
+
+/*
+ * Which signatures of a multi-signature message must verify. Signatures by
+ * the same key ID are only counted once towards a threshold.
+ */
+type Policy struct {
+	mode      string
+	threshold int
+}
+
+/* One of "first" (default), "any", "all" or "threshold:N" */
+func ParsePolicy(policy string) (Policy, error) {
+	switch policy {
+	case "", POLICY_FIRST:
+		return Policy{mode: POLICY_FIRST}, nil
+	case POLICY_ANY, POLICY_ALL:
+		return Policy{mode: policy}, nil
+	}
+
+	mode, n, found := strings.Cut(policy, ":")
+	if !found || mode != POLICY_THRESHOLD {
+		return Policy{}, fmt.Errorf("unknown signature policy '%s'", policy)
+	}
+
+	threshold, err := strconv.Atoi(n)
+	if err != nil || threshold < 1 {
+		return Policy{}, fmt.Errorf("bad signature threshold '%s'", n)
+	}
+
+	return Policy{mode: POLICY_THRESHOLD, threshold: threshold}, nil
+}
+
+/* How many of the signatures to look at */
+func (p Policy) Considered(total int) int {
+	if p.mode == POLICY_FIRST {
+		return min(total, 1)
+	}
+
+	return total
+}
+
+/* Whether the policy is met given the verified key IDs, one per signature */
+func (p Policy) Satisfied(verified []string, total int) bool {
+	distinct := make(map[string]bool, len(verified))
+	for _, keyID := range verified {
+		distinct[keyID] = true
+	}
+
+	switch p.mode {
+	case POLICY_FIRST, POLICY_ANY:
+		return len(verified) > 0
+	case POLICY_ALL:
+		return len(verified) == total
+	case POLICY_THRESHOLD:
+		return len(distinct) >= p.threshold
+	}
+
+	return false
+}
+
+/*
+ * Whether the policy can still be met with the signatures not yet looked at,
+ * so verification can stop at the first failure that rules it out
+ */
+func (p Policy) Reachable(verified []string, failed int, total int) bool {
+	switch p.mode {
+	case POLICY_ALL:
+		return failed == 0
+	case POLICY_THRESHOLD:
+		distinct := make(map[string]bool, len(verified))
+		for _, keyID := range verified {
+			distinct[keyID] = true
+		}
+		remaining := total - len(verified) - failed
+		return len(distinct)+remaining >= p.threshold
+	}
+
+	return true
+}
+
+func (p Policy) String() string {
+	if p.mode == POLICY_THRESHOLD {
+		return fmt.Sprintf("%s:%d", p.mode, p.threshold)
+	}
+
+	return p.mode
+}
@@ -0,0 +1,108 @@
+package upbridge
+
+import (
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	var tests = []struct {
+		name     string
+		policy   string
+		valid    bool
+		expected string
+	}{
+		{"DEFAULT", "", true, "first"},
+		{"FIRST", "first", true, "first"},
+		{"ANY", "any", true, "any"},
+		{"ALL", "all", true, "all"},
+		{"THRESHOLD", "threshold:2", true, "threshold:2"},
+		{"THRESHOLD_ZERO", "threshold:0", false, ""},
+		{"THRESHOLD_NAN", "threshold:two", false, ""},
+		{"THRESHOLD_MISSING", "threshold", false, ""},
+		{"UNKNOWN", "most", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy(tt.policy)
+			if (err == nil) != tt.valid {
+				t.Fatalf("got err '%v', expected valid: %t", err, tt.valid)
+			}
+			if err == nil && policy.String() != tt.expected {
+				t.Fatalf("got policy '%s', expected '%s'", policy, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPolicyReachable(t *testing.T) {
+	var tests = []struct {
+		name     string
+		policy   string
+		verified []string
+		failed   int
+		total    int
+		expected bool
+	}{
+		{"ANY_FAILED", "any", nil, 2, 3, true},
+		{"ALL_NONE_FAILED", "all", []string{"a"}, 0, 3, true},
+		{"ALL_ONE_FAILED", "all", []string{"a"}, 1, 3, false},
+		{"THRESHOLD_LEFT", "threshold:2", nil, 1, 3, true},
+		{"THRESHOLD_TOO_FEW_LEFT", "threshold:2", nil, 2, 3, false},
+		{"THRESHOLD_SAME_KEY", "threshold:2", []string{"a", "a"}, 0, 3, true},
+		{"THRESHOLD_SAME_KEY_NONE_LEFT", "threshold:2", []string{"a", "a"}, 1, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy(tt.policy)
+			if err != nil {
+				panic(err)
+			}
+
+			got := policy.Reachable(tt.verified, tt.failed, tt.total)
+			if got != tt.expected {
+				t.Fatalf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPolicySatisfied(t *testing.T) {
+	var tests = []struct {
+		name       string
+		policy     string
+		verified   []string
+		total      int
+		considered int
+		expected   bool
+	}{
+		{"FIRST_OK", "first", []string{"a"}, 2, 1, true},
+		{"FIRST_FAIL", "first", nil, 2, 1, false},
+		{"ANY_OK", "any", []string{"b"}, 3, 3, true},
+		{"ANY_FAIL", "any", nil, 3, 3, false},
+		{"ALL_OK", "all", []string{"a", "b"}, 2, 2, true},
+		{"ALL_FAIL", "all", []string{"a"}, 2, 2, false},
+		{"THRESHOLD_OK", "threshold:2", []string{"a", "c"}, 3, 3, true},
+		{"THRESHOLD_FAIL", "threshold:2", []string{"a"}, 3, 3, false},
+		{"THRESHOLD_SAME_KEY", "threshold:2", []string{"a", "a"}, 2, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy(tt.policy)
+			if err != nil {
+				panic(err)
+			}
+
+			if policy.Considered(tt.total) != tt.considered {
+				t.Fatalf("considered %d signatures, expected %d", policy.Considered(tt.total), tt.considered)
+			}
+
+			got := policy.Satisfied(tt.verified, tt.total)
+			if got != tt.expected {
+				t.Fatalf("got %t, expected %t", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package upbridge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/app/keys"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+/*
+ * Rejects stale and replayed messages based on the claims of the sender's
+ * signature. Seen IDs are kept per key ID for as long as a message would be
+ * accepted, or until evicted if there is no maximum age.
+ */
+type replayGuard struct {
+	maxAge time.Duration
+	skew   time.Duration
+	mu     sync.Mutex
+	seen   *expirable.LRU[string, struct{}]
+}
+
+var errStale = errors.New("stale message")
+var errReplay = errors.New("replayed message")
+
+/* Nil if no checks are configured */
+func newReplayGuard(maxAge, skew time.Duration, window int) (*replayGuard, error) {
+	if maxAge < 0 || skew < 0 || window < 0 {
+		return nil, errors.New("bad replay protection settings")
+	}
+
+	if maxAge == 0 && window == 0 {
+		return nil, nil
+	}
+
+	guard := &replayGuard{
+		maxAge: maxAge,
+		skew:   skew,
+	}
+
+	if window > 0 {
+		ttl := time.Duration(0)
+		if maxAge > 0 {
+			ttl = maxAge + 2*skew
+		}
+		guard.seen = expirable.NewLRU[string, struct{}](window, nil, ttl)
+	}
+
+	return guard, nil
+}
+
+func (g *replayGuard) check(keyID string, claims keys.Claims, now time.Time) error {
+	if !claims.Expiry.IsZero() && now.After(claims.Expiry.Add(g.skew)) {
+		return fmt.Errorf("%w: expired at %s", errStale, claims.Expiry)
+	}
+
+	if !claims.IssuedAt.IsZero() && claims.IssuedAt.After(now.Add(g.skew)) {
+		return fmt.Errorf("%w: issued in the future at %s", errStale, claims.IssuedAt)
+	}
+
+	if g.maxAge > 0 {
+		if claims.IssuedAt.IsZero() {
+			return fmt.Errorf("%w: no iat claim", errStale)
+		}
+		if now.Sub(claims.IssuedAt) > g.maxAge+g.skew {
+			return fmt.Errorf("%w: issued at %s", errStale, claims.IssuedAt)
+		}
+	}
+
+	if g.seen == nil {
+		return nil
+	}
+
+	if claims.ID == "" {
+		return fmt.Errorf("%w: no jti claim", errReplay)
+	}
+
+	/* IDs are only unique per signer */
+	seenKey := keyID + "\x00" + claims.ID
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.seen.Contains(seenKey) {
+		return fmt.Errorf("%w: jti '%s' already seen", errReplay, claims.ID)
+	}
+	g.seen.Add(seenKey, struct{}{})
+
+	return nil
+}
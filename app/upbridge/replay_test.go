@@ -0,0 +1,53 @@
+package upbridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/app/keys"
+)
+
+func TestReplayGuardCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	minute := time.Minute
+
+	var tests = []struct {
+		name    string
+		maxAge  time.Duration
+		window  int
+		claims  []keys.Claims
+		wantErr error
+	}{
+		{"FRESH", 5 * minute, 0, []keys.Claims{{IssuedAt: now.Add(-minute)}}, nil},
+		{"TOO_OLD", 5 * minute, 0, []keys.Claims{{IssuedAt: now.Add(-10 * minute)}}, errStale},
+		{"WITHIN_SKEW", 5 * minute, 0, []keys.Claims{{IssuedAt: now.Add(-5*minute - 20*time.Second)}}, nil},
+		{"FUTURE", 5 * minute, 0, []keys.Claims{{IssuedAt: now.Add(2 * minute)}}, errStale},
+		{"NO_IAT", 5 * minute, 0, []keys.Claims{{ID: "a"}}, errStale},
+		{"EXPIRED", 0, 10, []keys.Claims{{Expiry: now.Add(-minute), ID: "a"}}, errStale},
+		{"NO_JTI", 0, 10, []keys.Claims{{IssuedAt: now}}, errReplay},
+		{"DISTINCT_JTI", 0, 10, []keys.Claims{{ID: "a"}, {ID: "b"}}, nil},
+		{"REPLAYED_JTI", 5 * minute, 10, []keys.Claims{{IssuedAt: now, ID: "a"}, {IssuedAt: now, ID: "a"}}, errReplay},
+		{"EVICTED_JTI", 0, 1, []keys.Claims{{ID: "a"}, {ID: "b"}, {ID: "a"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guard, err := newReplayGuard(tt.maxAge, 30*time.Second, tt.window)
+			if err != nil {
+				t.Fatalf("Error creating guard: %s", err)
+			}
+
+			for _, claims := range tt.claims {
+				err = guard.check("node-a", claims, now)
+				if err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Got error '%v', expected '%v'", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,29 +1,80 @@
 package upbridge
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dnstapir/mqtt-bridge/shared"
 
 	"github.com/dnstapir/mqtt-bridge/app/cache"
 	"github.com/dnstapir/mqtt-bridge/app/keys"
 	"github.com/dnstapir/mqtt-bridge/app/schemaval"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+	"github.com/dnstapir/mqtt-bridge/app/topics"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
 )
 
+const cWORKER_QUEUE_SIZE = 64
+const cMAX_SIGNATURES = 4
+
 type upbridge struct {
 	log       shared.LoggerIF
 	stopCh    chan bool
 	key       keys.ValKey
-	schemaval *schemaval.Schemaval
+	schemaval atomic.Pointer[schemaval.Schemaval]
+	schema    string
 	lru       *cache.LruCache
 	nodeman   shared.NodemanIF
+	topic     *topics.Pattern
+	subject   *templates.Template
+	deadCh    chan<- shared.NatsData
+	revokeCh  <-chan shared.NatsData
+	workers   int
+	maxSigs   int
+	keyPath   string
+	keyMu     sync.Mutex
+	algs      []jwa.SignatureAlgorithm
+	policy    Policy
+	replay    *replayGuard
+	dedup     *deduper
+}
+
+type job struct {
+	mqttData shared.MqttData
+	msg      *keys.SignedMsg
 }
 
 type Conf struct {
-	Log     shared.LoggerIF
-	Nodeman shared.NodemanIF
-	Schema  string
-	Key     string
+	Log          shared.LoggerIF
+	Nodeman      shared.NodemanIF
+	Topic        *topics.Pattern
+	Subject      *templates.Template
+	DeadLetterCh chan<- shared.NatsData // Rejected messages, optional
+	RevocationCh <-chan shared.NatsData // Key IDs to drop from the cache, optional
+	Workers      int
+	CacheSize    int
+	CacheTTL     time.Duration
+	NegativeTTL  time.Duration // Remember keys unknown to nodeman this long, optional
+	Algorithms   []string      // All supported if empty
+	Policy       string        // Multi-signature policy, "first" if empty
+	MaxSigs      int           // Signatures per message, default cMAX_SIGNATURES
+	Schema       string
+	Key          string        // JWK, JWKS or directory of "<kid>.json" files, optional
+	MaxAge       time.Duration // Reject messages issued longer ago, optional
+	ClockSkew    time.Duration // Tolerance for the iat and exp claims
+	ReplayWindow int           // Number of seen jti claims to remember, optional
+	DedupWindow  time.Duration // Drop messages seen this long ago, optional
+	DedupSize    int           // Number of messages to remember, optional
+	DedupField   string        // Payload field identifying a message, else its hash
 }
 
 func Create(conf Conf) (*upbridge, error) {
@@ -39,9 +90,62 @@ func Create(conf Conf) (*upbridge, error) {
 	}
 	newUpbridge.nodeman = conf.Nodeman
 
+	if conf.Topic == nil {
+		return nil, errors.New("error setting topic pattern")
+	}
+	newUpbridge.topic = conf.Topic
+
+	if conf.Subject == nil {
+		return nil, errors.New("error setting subject template")
+	}
+	newUpbridge.subject = conf.Subject
+	newUpbridge.deadCh = conf.DeadLetterCh
+	newUpbridge.revokeCh = conf.RevocationCh
+
+	if conf.Workers < 0 {
+		return nil, errors.New("bad number of workers")
+	}
+	newUpbridge.workers = max(conf.Workers, 1)
+
+	algs, err := keys.ParseAlgorithms(conf.Algorithms)
+	if err != nil {
+		return nil, err
+	}
+	newUpbridge.algs = algs
+
+	policy, err := ParsePolicy(conf.Policy)
+	if err != nil {
+		return nil, err
+	}
+	newUpbridge.policy = policy
+
+	if conf.MaxSigs < 0 {
+		return nil, errors.New("bad maximum number of signatures")
+	}
+	newUpbridge.maxSigs = conf.MaxSigs
+	if newUpbridge.maxSigs == 0 {
+		newUpbridge.maxSigs = cMAX_SIGNATURES
+	}
+
+	replay, err := newReplayGuard(conf.MaxAge, conf.ClockSkew, conf.ReplayWindow)
+	if err != nil {
+		return nil, err
+	}
+	newUpbridge.replay = replay
+
+	dedup, err := newDeduper(newUpbridge.log, conf.DedupWindow, conf.DedupSize, conf.DedupField)
+	if err != nil {
+		return nil, err
+	}
+	newUpbridge.dedup = dedup
+
 	newUpbridge.stopCh = make(chan bool, 1)
 
-	cacheConf := cache.Conf{}
+	cacheConf := cache.Conf{
+		Size:        conf.CacheSize,
+		TTL:         conf.CacheTTL,
+		NegativeTTL: conf.NegativeTTL,
+	}
 	lruCache, err := cache.Create(cacheConf)
 	if err != nil {
 		return nil, errors.New("error creating key cache")
@@ -49,99 +153,418 @@ func Create(conf Conf) (*upbridge, error) {
 	newUpbridge.lru = lruCache
 
 	if conf.Key != "" {
-		key, err := keys.GetValKey(conf.Key)
-		if err != nil {
-			return nil, errors.New("error getting validation key")
-		}
-
-		err = newUpbridge.lru.StoreValkeyInCache(key)
+		newUpbridge.keyPath = conf.Key
+		err = newUpbridge.loadKeys()
 		if err != nil {
-			return nil, errors.New("error storing validation key")
+			return nil, err
 		}
 	}
 
-	schemaConf := schemaval.Conf{
-		Log:      conf.Log,
-		Filename: conf.Schema,
-	}
-	schema, err := schemaval.Create(schemaConf)
+	newUpbridge.schema = conf.Schema
+	schema, err := newUpbridge.loadSchema()
 	if err != nil {
 		return nil, err
 	}
-	newUpbridge.schemaval = schema
+	newUpbridge.schemaval.Store(schema)
 
 	return newUpbridge, nil
 }
 
 func (ub *upbridge) Start(mqttCh <-chan shared.MqttData, natsCh chan<- shared.NatsData) {
+	var wg sync.WaitGroup
+
+	workerChs := make([]chan job, ub.workers)
+	for i := range workerChs {
+		workerChs[i] = make(chan job, cWORKER_QUEUE_SIZE)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range workerChs[i] {
+				ub.process(j, natsCh)
+			}
+		}()
+	}
+
+	defer func() {
+		for _, ch := range workerChs {
+			close(ch)
+		}
+		wg.Wait()
+	}()
+
 	for {
 		select {
 		case <-ub.stopCh:
 			ub.log.Info("Stopping upbound bridge")
 			return
-		case mqttData := <-mqttCh:
-			outgoingMsg := shared.NatsData{
-				Payload: nil,
-				Headers: make(map[string]string),
+		case natsData, ok := <-ub.revokeCh:
+			if !ok {
+				ub.log.Warning("Revocation channel closed, keys will only expire")
+				ub.revokeCh = nil
+				continue
+			}
+			ub.revoke(natsData)
+		case mqttData, ok := <-mqttCh:
+			if !ok {
+				ub.log.Warning("MQTT channel closed, stopping upbound bridge")
+				return
 			}
 
-			sig := mqttData.Payload
-			keyID, err := keys.GetKeyIDFromSignedData(sig)
-			ub.log.Debug("Got MQTT message from '%s'", keyID)
+			msg, err := keys.ParseSigned(mqttData.Payload)
 			if err != nil {
 				ub.log.Error("Error getting key ID from signed data, err: '%s'", err)
+				ub.deadLetter(mqttData, "", shared.REJECT_REASON_MALFORMED_JWS, err)
 				continue
 			}
+			keyID := msg.KeyID()
+			ub.log.Debug("Got MQTT message from '%s'", keyID)
 
-			key := ub.lru.GetValkeyFromCache(keyID)
-			if key == nil {
-				ub.log.Info("Key not found in cache, contacting nodeman", keyID)
-				newKeyBytes, err := ub.nodeman.GetKey(keyID)
-				if err != nil {
-					ub.log.Error("Error getting key '%s' from Nodeman, err: %s", keyID, err)
-					continue
-				}
-
-				newKey, err := keys.ParseValKey(newKeyBytes)
-				if err != nil {
-					ub.log.Error("Error parsing key '%s', err: %s", keyID, err)
-					continue
-				}
-
-				err = ub.lru.StoreValkeyInCache(newKey)
-				if err != nil {
-					ub.log.Error("Error caching key '%s', err: %s", keyID, err)
-					continue
-				}
-
-				key = newKey
-			}
-
-			data, err := keys.CheckSignature(sig, key)
-			if err != nil {
-				ub.log.Error("Bad signature from MQTT, err: '%s'", err)
+			/* Each signature may cost a nodeman lookup */
+			if msg.NumSignatures() > ub.maxSigs {
+				err := fmt.Errorf("%d signatures, at most %d allowed", msg.NumSignatures(), ub.maxSigs)
+				ub.log.Error("Too many signatures in message from '%s', discarding...", keyID)
+				ub.deadLetter(mqttData, keyID, shared.REJECT_REASON_MALFORMED_JWS, err)
 				continue
 			}
-			ub.log.Debug("Signature with ID '%s' ok", keyID)
-
-			outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_MESSAGE_SCHEMA] = ub.schemaval.GetID()
-			outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC] = mqttData.Topic
-			outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER] = keyID
-			outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_KEY_THUMBPRINT] = keys.GetThumbprint(key)
-
-			ok := ub.schemaval.Validate(data)
-			if ok {
-				outgoingMsg.Payload = data
-				natsCh <- outgoingMsg
-				ub.log.Debug("Handed over %d bytes to NATS", len(data))
-			} else {
-				ub.log.Error("Malformed data from MQTT, discarding...")
+
+			/* Messages from the same sender always go to the same worker */
+			select {
+			case workerChs[shard(keyID, len(workerChs))] <- job{mqttData: mqttData, msg: msg}:
+			case <-ub.stopCh:
+				ub.log.Info("Stopping upbound bridge")
+				return
 			}
-			ub.log.Debug("Processing of message from '%s' done!", keyID)
 		}
 	}
 }
 
+func (ub *upbridge) process(j job, natsCh chan<- shared.NatsData) {
+	mqttData := j.mqttData
+	keyID := j.msg.KeyID()
+	sig := mqttData.Payload
+
+	outgoingMsg := shared.NatsData{
+		Payload: nil,
+		Headers: make(map[string]string),
+	}
+
+	/* The key ID in the topic must be one of the signers, checked before any lookup */
+	topicKeyID := ""
+	if ub.topic.IsKeyBound() {
+		var ok bool
+		topicKeyID, ok = ub.topic.KeyIDFromTopic(mqttData.Topic)
+		if !ok || !signedBy(j.msg, topicKeyID) {
+			ub.log.Error("Key IDs '%s' do not match key ID '%s' from topic '%s', discarding...", strings.Join(signatureKeyIDs(j.msg), ","), topicKeyID, mqttData.Topic)
+			err := fmt.Errorf("no signature by topic key id '%s'", topicKeyID)
+			ub.deadLetter(mqttData, keyID, shared.REJECT_REASON_TOPIC_MISMATCH, err)
+			return
+		}
+		ub.log.Debug("Key ID '%s' matches topic '%s'", topicKeyID, mqttData.Topic)
+	}
+
+	v, reason, err := ub.verify(j.msg)
+	if err != nil {
+		ub.log.Error("Signature policy '%s' not met for message from '%s', err: '%s'", ub.policy, keyID, err)
+		ub.deadLetter(mqttData, keyID, reason, err)
+		return
+	}
+	data := v.payload
+
+	/* The sender is the topic owner if bound, else the first verified signer */
+	senderIdx := 0
+	if topicKeyID != "" {
+		senderIdx = slices.Index(v.keyIDs, topicKeyID)
+		if senderIdx < 0 {
+			ub.log.Error("Signature by topic key ID '%s' did not verify, discarding...", topicKeyID)
+			err := fmt.Errorf("signature by topic key id '%s' not verified", topicKeyID)
+			ub.deadLetter(mqttData, keyID, shared.REJECT_REASON_BAD_SIGNATURE, err)
+			return
+		}
+	}
+	keyID = v.keyIDs[senderIdx]
+	ub.log.Debug("Signatures from '%s' ok", strings.Join(v.keyIDs, ","))
+
+	if ub.replay != nil {
+		reason, err := ub.checkReplay(j.msg, v.indices[senderIdx], keyID)
+		if err != nil {
+			ub.log.Error("Rejected message from '%s', err: '%s'", keyID, err)
+			ub.deadLetter(mqttData, keyID, reason, err)
+			return
+		}
+	}
+
+	vars := templates.Vars{
+		KeyID: keyID,
+		Topic: strings.Split(mqttData.Topic, "/"),
+	}
+	subject, err := ub.subject.Execute(vars)
+	if err != nil {
+		ub.log.Error("Error creating NATS subject for topic '%s', err: '%s'", mqttData.Topic, err)
+		ub.deadLetter(mqttData, keyID, shared.REJECT_REASON_TEMPLATE, err)
+		return
+	}
+	outgoingMsg.Subject = subject
+
+	sigHash := sha256.Sum256(sig)
+	outgoingMsg.MsgID = hex.EncodeToString(sigHash[:])
+
+	schema := ub.schemaval.Load()
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_MESSAGE_SCHEMA] = schema.GetID()
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC] = mqttData.Topic
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER] = keyID
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_KEY_THUMBPRINT] = v.thumbprints[senderIdx]
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_VERIFIED_KEY_IDENTIFIERS] = strings.Join(v.keyIDs, ",")
+	outgoingMsg.Headers[shared.NATSHEADER_DNSTAPIR_VERIFIED_KEY_THUMBPRINTS] = strings.Join(v.thumbprints, ",")
+
+	err = schema.Validate(data)
+	if err == nil {
+		if ub.dedup != nil && ub.dedup.duplicate(keyID, outgoingMsg.MsgID, data) {
+			return
+		}
+		outgoingMsg.Payload = data
+		if !ub.send(natsCh, outgoingMsg) {
+			return
+		}
+		ub.log.Debug("Handed over %d bytes to NATS", len(data))
+	} else {
+		ub.log.Error("Malformed data from MQTT, discarding...")
+		ub.deadLetter(mqttData, keyID, shared.REJECT_REASON_SCHEMA, err)
+	}
+
+	ub.log.Debug("Processing of message from '%s' done!", keyID)
+}
+
+/* Verified signatures, in the order they appear in the message */
+type verification struct {
+	indices     []int
+	keyIDs      []string
+	thumbprints []string
+	payload     []byte
+}
+
+/*
+ * Resolve and verify each signature considered by the policy by its own key
+ * ID, stopping once the policy can no longer be met. On failure the reject
+ * reason is that of the first failing signature.
+ */
+func (ub *upbridge) verify(msg *keys.SignedMsg) (verification, string, error) {
+	var v verification
+	var errs []error
+	reason := ""
+	total := msg.NumSignatures()
+
+	fail := func(r string, err error) {
+		if reason == "" {
+			reason = r
+		}
+		errs = append(errs, err)
+	}
+
+	for i := range ub.policy.Considered(total) {
+		if !ub.policy.Reachable(v.keyIDs, len(errs), total) {
+			break
+		}
+
+		keyID := msg.SignatureKeyID(i)
+		if keyID == "" {
+			fail(shared.REJECT_REASON_BAD_SIGNATURE, fmt.Errorf("signature %d has no key id", i))
+			continue
+		}
+
+		key, cached, err := ub.lru.GetOrFetchValkey(keyID, ub.fetchKey)
+		if err != nil {
+			ub.log.Warning("Error getting key '%s', err: %s", keyID, err)
+			fail(shared.REJECT_REASON_KEY_LOOKUP, fmt.Errorf("key '%s': %w", keyID, err))
+			continue
+		}
+		if !cached {
+			ub.log.Debug("Key '%s' fetched from nodeman", keyID)
+		}
+
+		data, err := msg.VerifySignature(i, key, ub.algs)
+		if err != nil {
+			fail(shared.REJECT_REASON_BAD_SIGNATURE, fmt.Errorf("key '%s': %w", keyID, err))
+			continue
+		}
+
+		v.indices = append(v.indices, i)
+		v.keyIDs = append(v.keyIDs, keyID)
+		v.thumbprints = append(v.thumbprints, keys.GetThumbprint(key))
+		v.payload = data
+	}
+
+	if !ub.policy.Satisfied(v.keyIDs, total) {
+		if reason == "" {
+			reason = shared.REJECT_REASON_BAD_SIGNATURE
+		}
+		errs = append(errs, fmt.Errorf("%d of %d signatures verified", len(v.keyIDs), total))
+		return v, reason, errors.Join(errs...)
+	}
+
+	return v, "", nil
+}
+
+/* Only the claims of the sender's verified signature are trusted */
+func (ub *upbridge) checkReplay(msg *keys.SignedMsg, i int, keyID string) (string, error) {
+	claims, err := msg.SignatureClaims(i)
+	if err != nil {
+		return shared.REJECT_REASON_STALE, err
+	}
+
+	err = ub.replay.check(keyID, claims, time.Now())
+	if errors.Is(err, errReplay) {
+		return shared.REJECT_REASON_REPLAY, err
+	} else if err != nil {
+		return shared.REJECT_REASON_STALE, err
+	}
+
+	return "", nil
+}
+
+func signedBy(msg *keys.SignedMsg, keyID string) bool {
+	return slices.Contains(signatureKeyIDs(msg), keyID)
+}
+
+func signatureKeyIDs(msg *keys.SignedMsg) []string {
+	keyIDs := make([]string, 0, msg.NumSignatures())
+	for i := range msg.NumSignatures() {
+		keyIDs = append(keyIDs, msg.SignatureKeyID(i))
+	}
+
+	return keyIDs
+}
+
+func (ub *upbridge) fetchKey(keyID string) (keys.ValKey, error) {
+	ub.log.Info("Key '%s' not found in cache, contacting nodeman", keyID)
+
+	newKeyBytes, err := ub.nodeman.GetKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	newKey, err := keys.ParseValKey(newKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey, nil
+}
+
+/* Serialized, reloads come both from SIGHUP and from watching the files */
+func (ub *upbridge) loadKeys() error {
+	ub.keyMu.Lock()
+	defer ub.keyMu.Unlock()
+
+	valKeys, err := keys.LoadValKeys(ub.keyPath)
+	if err != nil {
+		return errors.New("error getting validation keys")
+	}
+
+	err = ub.lru.SetPinnedValkeys(valKeys)
+	if err != nil {
+		return errors.New("error storing validation keys")
+	}
+
+	ub.log.Info("Loaded %d validation keys from '%s'", len(valKeys), ub.keyPath)
+
+	return nil
+}
+
+func (ub *upbridge) loadSchema() (*schemaval.Schemaval, error) {
+	schemaConf := schemaval.Conf{
+		Log:      ub.log,
+		Filename: ub.schema,
+	}
+
+	return schemaval.Create(schemaConf)
+}
+
+/*
+ * Load validation keys and schema again, e.g. on SIGHUP. Each is only
+ * replaced if the new one is valid.
+ */
+func (ub *upbridge) Reload() error {
+	var errs []error
+
+	if ub.keyPath != "" {
+		err := ub.loadKeys()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("validation keys '%s': %w", ub.keyPath, err))
+		}
+	}
+
+	schema, err := ub.loadSchema()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("schema '%s': %w", ub.schema, err))
+	} else {
+		ub.schemaval.Store(schema)
+		ub.log.Info("Reloaded schema '%s'", ub.schema)
+	}
+
+	return errors.Join(errs...)
+}
+
+/* The payload of a revocation message is the key ID */
+func (ub *upbridge) revoke(natsData shared.NatsData) {
+	keyID := strings.TrimSpace(string(natsData.Payload))
+	if keyID == "" {
+		ub.log.Warning("Empty key ID in revocation message on subject '%s'", natsData.Subject)
+		return
+	}
+
+	ok := ub.lru.RevokeValkey(keyID)
+	if !ok {
+		ub.log.Warning("Key '%s' is statically configured and cannot be revoked", keyID)
+		return
+	}
+
+	ub.log.Info("Key '%s' revoked, will be fetched again if still valid", keyID)
+}
+
+func shard(keyID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(keyID))
+	return int(h.Sum32() % uint32(n))
+}
+
+/* Hand over the raw signed message for inspection and replay, if configured */
+func (ub *upbridge) deadLetter(mqttData shared.MqttData, keyID, reason string, err error) {
+	if ub.deadCh == nil {
+		return
+	}
+
+	deadMsg := shared.NatsData{
+		Payload: mqttData.Payload,
+		Headers: make(map[string]string),
+	}
+
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON] = reason
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_ERROR] = shared.HeaderValue(err.Error())
+	deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC] = mqttData.Topic
+	if keyID != "" {
+		deadMsg.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER] = keyID
+	}
+
+	if !ub.send(ub.deadCh, deadMsg) {
+		return
+	}
+	ub.log.Debug("Dead-lettered message on topic '%s', reason: '%s'", mqttData.Topic, reason)
+}
+
+/*
+ * Gives up once the bridge is stopping, so a publisher that is not making
+ * progress can not keep the bridge from stopping
+ */
+func (ub *upbridge) send(ch chan<- shared.NatsData, natsData shared.NatsData) bool {
+	select {
+	case ch <- natsData:
+		return true
+	case <-ub.stopCh:
+		ub.log.Warning("Bridge stopping, dropping message for NATS subject '%s'", natsData.Subject)
+		return false
+	}
+}
+
 func (ub *upbridge) Stop() {
 	ub.stopCh <- true
 	close(ub.stopCh)
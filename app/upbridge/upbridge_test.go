@@ -0,0 +1,216 @@
+package upbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+	"github.com/dnstapir/mqtt-bridge/app/topics"
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+
+	"github.com/lestrrat-go/jwx/v2/jws"
+)
+
+/* Knows no keys, counting the lookups */
+type countingNodeman struct {
+	lookups atomic.Int32
+}
+
+func (n *countingNodeman) GetKey(keyID string) ([]byte, error) {
+	n.lookups.Add(1)
+	return nil, shared.ErrNodemanKeyNotFound
+}
+
+func newTestUpbridge(conf Conf) *upbridge {
+	topic, err := topics.ParsePattern("testtopic")
+	if err != nil {
+		panic(err)
+	}
+	subject, err := templates.ForNatsSubject("testsubject")
+	if err != nil {
+		panic(err)
+	}
+
+	conf.Log = fake.QuietLogger()
+	conf.Topic = topic
+	conf.Subject = subject
+
+	ub, err := Create(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	return ub
+}
+
+/* Signed by n keys with distinct key IDs, as many as nodeman would be asked for */
+func signByMany(t *testing.T, n int) []byte {
+	workdir := t.TempDir()
+
+	opts := []jws.SignOption{jws.WithJSON()}
+	for i := range n {
+		kid := fmt.Sprintf("random-%d", i)
+		key, err := keys.GenerateSignKey(filepath.Join(workdir, kid+".json"), kid)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, jws.WithKey(key.Algorithm(), key))
+	}
+
+	signed, err := jws.Sign([]byte(`{"foo": "bar"}`), opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	return signed
+}
+
+func TestVerifyBoundsLookups(t *testing.T) {
+	err := keys.SetLogger(fake.QuietLogger())
+	if err != nil {
+		panic(err)
+	}
+
+	var tests = []struct {
+		name       string
+		policy     string
+		maxSigs    int
+		sigs       int
+		wantReason string
+		lookups    int32
+	}{
+		{"TOO_MANY", "any", 2, 3, shared.REJECT_REASON_MALFORMED_JWS, 0},
+		{"TOO_MANY_DEFAULT", "any", 0, cMAX_SIGNATURES + 1, shared.REJECT_REASON_MALFORMED_JWS, 0},
+		{"ANY", "any", 0, 3, shared.REJECT_REASON_KEY_LOOKUP, 3},
+		{"ALL_FIRST_FAILURE", "all", 0, 3, shared.REJECT_REASON_KEY_LOOKUP, 1},
+		{"THRESHOLD_UNREACHABLE", "threshold:2", 0, 3, shared.REJECT_REASON_KEY_LOOKUP, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeman := new(countingNodeman)
+			deadCh := make(chan shared.NatsData, 1)
+			ub := newTestUpbridge(Conf{
+				Nodeman:      nodeman,
+				DeadLetterCh: deadCh,
+				Policy:       tt.policy,
+				MaxSigs:      tt.maxSigs,
+			})
+
+			mqttCh := make(chan shared.MqttData)
+			natsCh := make(chan shared.NatsData)
+			go ub.Start(mqttCh, natsCh)
+			defer ub.Stop()
+
+			mqttCh <- shared.MqttData{Payload: signByMany(t, tt.sigs), Topic: "testtopic"}
+			dead := <-deadCh
+
+			reason := dead.Headers[shared.NATSHEADER_DNSTAPIR_REJECT_REASON]
+			if reason != tt.wantReason {
+				t.Fatalf("got reject reason '%s', expected '%s'", reason, tt.wantReason)
+			}
+			if nodeman.lookups.Load() != tt.lookups {
+				t.Fatalf("got %d lookups, expected %d", nodeman.lookups.Load(), tt.lookups)
+			}
+		})
+	}
+}
+
+/* Pinned values, a change would reorder messages in flight across an upgrade */
+func TestShard(t *testing.T) {
+	var tests = []struct {
+		keyID    string
+		n        int
+		expected int
+	}{
+		{"node-a", 1, 0},
+		{"node-a", 4, 3},
+		{"node-b", 4, 2},
+		{"node-c", 4, 1},
+		{"node-d", 4, 0},
+		{"node-d", 16, 12},
+		{"", 4, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.keyID, tt.n), func(t *testing.T) {
+			for range 3 {
+				got := shard(tt.keyID, tt.n)
+				if got != tt.expected {
+					t.Fatalf("got shard %d, expected %d", got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestWorkersKeepSenderOrder(t *testing.T) {
+	err := keys.SetLogger(fake.QuietLogger())
+	if err != nil {
+		panic(err)
+	}
+
+	/* One worker each, see TestShard */
+	kids := []string{"node-a", "node-b", "node-c", "node-d"}
+	const perKid = 50
+
+	keydir := filepath.Join(t.TempDir(), "keys")
+	err = os.Mkdir(keydir, 0750)
+	if err != nil {
+		panic(err)
+	}
+	signKeys := make(map[string]keys.SignKey, len(kids))
+	for _, kid := range kids {
+		signKeys[kid], err = keys.GenerateSignKey(filepath.Join(keydir, kid+".json"), kid)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	ub := newTestUpbridge(Conf{
+		Nodeman: new(countingNodeman),
+		Key:     keydir,
+		Workers: len(kids),
+	})
+
+	mqttCh := make(chan shared.MqttData)
+	natsCh := make(chan shared.NatsData, len(kids)*perKid)
+	go ub.Start(mqttCh, natsCh)
+	defer ub.Stop()
+
+	for seq := range perKid {
+		for _, kid := range kids {
+			data := fmt.Sprintf(`{"seq": %d}`, seq)
+			signed, err := keys.Sign([]byte(data), signKeys[kid])
+			if err != nil {
+				panic(err)
+			}
+			mqttCh <- shared.MqttData{Payload: signed, Topic: "testtopic"}
+		}
+	}
+
+	next := make(map[string]int, len(kids))
+	for range len(kids) * perKid {
+		out := <-natsCh
+		kid := out.Headers[shared.NATSHEADER_DNSTAPIR_KEY_IDENTIFIER]
+
+		var payload struct {
+			Seq int `json:"seq"`
+		}
+		err := json.Unmarshal(out.Payload, &payload)
+		if err != nil {
+			panic(err)
+		}
+
+		if payload.Seq != next[kid] {
+			t.Fatalf("got message %d from '%s', expected %d", payload.Seq, kid, next[kid])
+		}
+		next[kid]++
+	}
+}
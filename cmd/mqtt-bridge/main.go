@@ -17,7 +17,6 @@ const c_ENVVAR_OVERRIDE_NATS_URL = "DNSTAPIR_BRIDGE_NATS_URL"
 
 func main() {
 	var configFile string
-	var appConf setup.AppConf
 
 	flag.StringVar(&configFile,
 		"config-file",
@@ -27,12 +26,7 @@ func main() {
 
 	flag.Parse()
 
-	file, err := os.ReadFile(configFile)
-	if err != nil {
-		panic(err)
-	}
-
-	err = toml.Unmarshal(file, &appConf)
+	appConf, err := readConfig(configFile)
 	if err != nil {
 		panic(err)
 	}
@@ -57,6 +51,10 @@ func main() {
 	defer close(sigChan)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	hupChan := make(chan os.Signal, 1)
+	defer close(hupChan)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
 	err = application.Initialize()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing application: '%s', exiting...\n", err)
@@ -65,14 +63,30 @@ func main() {
 
 	done := application.Run()
 
-	select {
-	case s := <-sigChan:
-		fmt.Fprintf(os.Stderr, "Got signal '%s', exiting...\n", s)
-	case err := <-done:
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "App exited with error: '%s'\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "Done!\n")
+	running := true
+	for running {
+		select {
+		case <-hupChan:
+			fmt.Fprintf(os.Stderr, "Got SIGHUP, reloading bridges...\n")
+			newConf, err := readConfig(configFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error reading config: '%s', keeping old bridges\n", err)
+				continue
+			}
+			err = application.Reload(newConf.Bridges)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reload incomplete: '%s'\n", err)
+			}
+		case s := <-sigChan:
+			fmt.Fprintf(os.Stderr, "Got signal '%s', exiting...\n", s)
+			running = false
+		case err := <-done:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "App exited with error: '%s'\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Done!\n")
+			}
+			running = false
 		}
 	}
 
@@ -84,3 +98,20 @@ func main() {
 
 	os.Exit(0)
 }
+
+/* Only the bridges are taken from the config file again on reload */
+func readConfig(configFile string) (setup.AppConf, error) {
+	var appConf setup.AppConf
+
+	file, err := os.ReadFile(configFile)
+	if err != nil {
+		return appConf, err
+	}
+
+	err = toml.Unmarshal(file, &appConf)
+	if err != nil {
+		return appConf, err
+	}
+
+	return appConf, nil
+}
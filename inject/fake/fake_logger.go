@@ -3,6 +3,7 @@ package fake
 import "fmt"
 
 type logger struct {
+	quiet bool
 }
 
 func Logger() *logger {
@@ -10,6 +11,13 @@ func Logger() *logger {
 	return logger
 }
 
+/* For tests exercising paths that are expected to log errors */
+func QuietLogger() *logger {
+	logger := new(logger)
+	logger.quiet = true
+	return logger
+}
+
 func (l *logger) Debug(fmtStr string, vals ...any) {
 }
 
@@ -20,6 +28,9 @@ func (l *logger) Warning(fmtStr string, vals ...any) {
 }
 
 func (l *logger) Error(fmtStr string, vals ...any) {
+	if l.quiet {
+		return
+	}
 	panic(format(fmtStr, vals))
 }
 
@@ -6,13 +6,13 @@ import (
 
 type mqtt struct {
 	subCh chan shared.MqttData
-	pubCh chan []byte
+	pubCh chan shared.MqttData
 }
 
 func Mqtt() *mqtt {
 	mqtt := new(mqtt)
 	mqtt.subCh = make(chan shared.MqttData, 1)
-	mqtt.pubCh = make(chan []byte)
+	mqtt.pubCh = make(chan shared.MqttData)
 
 	return mqtt
 }
@@ -21,10 +21,15 @@ func (m *mqtt) Connect() error {
 	return nil
 }
 
-func (m *mqtt) Subscribe(topic string) (<-chan shared.MqttData, error) {
+func (m *mqtt) Subscribe(topic string, qos byte, queueConf shared.QueueConf) (<-chan shared.MqttData, error) {
 	return m.subCh, nil
 }
 
+/* All subscriptions share one channel, which is thus never closed */
+func (m *mqtt) Unsubscribe(ch <-chan shared.MqttData) error {
+	return nil
+}
+
 func (m *mqtt) Stop() {
 }
 
@@ -32,15 +37,27 @@ func (m *mqtt) Inject(data shared.MqttData) {
 	m.subCh <- data
 }
 
-func (m *mqtt) StartPublishing(subject string, retain bool) (chan<- []byte, error) {
-	return m.pubCh, nil
+/* Like the real client, each publisher can be closed on its own */
+func (m *mqtt) StartPublishing(subject string, retain bool, qos byte) (chan<- shared.MqttData, error) {
+	dataChan := make(chan shared.MqttData)
+	go func() {
+		for data := range dataChan {
+			m.pubCh <- data
+		}
+	}()
+
+	return dataChan, nil
 }
 
 func (m *mqtt) CheckConnection() bool {
 	return true
 }
 
-func (m *mqtt) Eavesdrop() []byte {
+/* Acts as if the message was successfully published */
+func (m *mqtt) Eavesdrop() shared.MqttData {
 	data := <-m.pubCh
+	if data.Done != nil {
+		data.Done(nil)
+	}
 	return data
 }
@@ -1,17 +1,19 @@
 package fake
 
 import (
+	"time"
+
 	"github.com/dnstapir/mqtt-bridge/shared"
 )
 
 type nats struct {
-	subCh chan []byte
+	subCh chan shared.NatsData
 	pubCh chan shared.NatsData
 }
 
 func Nats() *nats {
 	nats := new(nats)
-	nats.subCh = make(chan []byte, 1)
+	nats.subCh = make(chan shared.NatsData, 1)
 	nats.pubCh = make(chan shared.NatsData)
 
 	return nats
@@ -20,22 +22,94 @@ func (n *nats) Connect() error {
 	return nil
 }
 
-func (n *nats) Subscribe(subject string, queue string) (<-chan []byte, error) {
+func (n *nats) Subscribe(subject string, queue string, queueConf shared.QueueConf) (<-chan shared.NatsData, error) {
+	return n.subCh, nil
+}
+
+func (n *nats) SubscribeDurable(stream string, consumer string, subject string, queueConf shared.QueueConf) (<-chan shared.NatsData, error) {
 	return n.subCh, nil
 }
 
+/* All subscriptions share one channel, which is thus never closed */
+func (n *nats) Unsubscribe(ch <-chan shared.NatsData) error {
+	return nil
+}
+
 func (n *nats) Stop() {
 }
 
-func (n *nats) Inject(data []byte) {
+/* Like the real client, messages always carry headers */
+func (n *nats) Inject(data shared.NatsData) {
+	if data.Headers == nil {
+		data.Headers = make(map[string]string)
+	}
 	n.subCh <- data
 }
 
+/*
+ * Like the real client, each publisher can be closed on its own and the
+ * subject of a message defaults to that of the publisher
+ */
 func (n *nats) StartPublishing(subject string, queue string) (chan<- shared.NatsData, error) {
-	return n.pubCh, nil
+	dataChan := make(chan shared.NatsData)
+	go func() {
+		for data := range dataChan {
+			if data.Subject == "" {
+				data.Subject = subject
+			}
+			n.pubCh <- data
+		}
+	}()
+
+	return dataChan, nil
+}
+
+/* Like the real client, messages not yet published are dropped on cancel */
+func (n *nats) StartJetStreamPublishing(subject string, cancel <-chan struct{}) (chan<- shared.NatsData, error) {
+	dataChan := make(chan shared.NatsData)
+	go func() {
+		for data := range dataChan {
+			if data.Subject == "" {
+				data.Subject = subject
+			}
+			select {
+			case n.pubCh <- data:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+
+	return dataChan, nil
 }
 
 func (n *nats) Eavesdrop() shared.NatsData {
 	data := <-n.pubCh
 	return data
 }
+
+type acker struct {
+	Acked  bool
+	Naked  bool
+	Termed bool
+}
+
+func Acker() *acker {
+	acker := new(acker)
+	return acker
+}
+
+func (a *acker) Ack() error {
+	a.Acked = true
+	return nil
+}
+
+func (a *acker) NakWithDelay(delay time.Duration) error {
+	a.Naked = true
+	return nil
+}
+
+func (a *acker) Term() error {
+	a.Termed = true
+	return nil
+}
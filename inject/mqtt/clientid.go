@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"errors"
+	"strings"
+)
+
+const cCLIENTID_HOSTNAME = "{hostname}"
+const cCLIENTID_REPLICA = "{replica}"
+const cENVVAR_REPLICA_INDEX = "DNSTAPIR_BRIDGE_REPLICA_INDEX"
+
+/*
+ * Fill in the client id template, so that replicas sharing a config file
+ * still get stable ids of their own. The replica index is taken from the
+ * environment or else from a trailing "-N" in the hostname, as given to the
+ * pods of e.g. a Kubernetes StatefulSet.
+ */
+func expandClientId(tmpl string, hostname func() (string, error), lookupEnv func(string) (string, bool)) (string, error) {
+	if !strings.Contains(tmpl, cCLIENTID_HOSTNAME) && !strings.Contains(tmpl, cCLIENTID_REPLICA) {
+		return tmpl, nil
+	}
+
+	host, err := hostname()
+	if err != nil {
+		return "", errors.New("error getting hostname for mqtt client id")
+	}
+
+	clientId := strings.ReplaceAll(tmpl, cCLIENTID_HOSTNAME, host)
+	if !strings.Contains(clientId, cCLIENTID_REPLICA) {
+		return clientId, nil
+	}
+
+	replica, ok := lookupEnv(cENVVAR_REPLICA_INDEX)
+	if !ok {
+		replica, ok = replicaFromHostname(host)
+	}
+	if !ok || replica == "" {
+		return "", errors.New("no replica index for mqtt client id")
+	}
+
+	return strings.ReplaceAll(clientId, cCLIENTID_REPLICA, replica), nil
+}
+
+func replicaFromHostname(host string) (string, bool) {
+	idx := strings.LastIndexByte(host, '-')
+	if idx < 0 || idx == len(host)-1 {
+		return "", false
+	}
+
+	ordinal := host[idx+1:]
+	for _, c := range ordinal {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+
+	return ordinal, true
+}
@@ -7,16 +7,27 @@ import (
 	"errors"
 	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dnstapir/mqtt-bridge/inject/queue"
 	"github.com/dnstapir/mqtt-bridge/shared"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
 )
 
-const c_MQTT_TIMEOUT = 30
+/* Defaults, the session settings are those used before they were configurable */
+const c_MQTT_TIMEOUT = 30 * time.Second
+const c_MQTT_KEEPALIVE = 20
+const c_MQTT_SESSION_EXPIRY = 500
+const c_MQTT_DEFAULT_OVERFLOW = shared.OVERFLOW_DROP_NEWEST
+
+/* Warn about every n:th dropped QoS>0 message to avoid flooding the log */
+const cDROPPED_ACKED_LOG_INTERVAL = 1000
 
 type Conf struct {
 	Log            shared.LoggerIF
@@ -24,23 +35,43 @@ type Conf struct {
 	MqttCaCert     string
 	MqttClientCert string
 	MqttClientKey  string
+	ClientId       string        // May contain "{hostname}" and "{replica}", optional
+	KeepAlive      *uint16       // Seconds, 0 disables keepalives, optional
+	SessionExpiry  *uint32       // Seconds, 0 ends the session on disconnect, optional
+	CleanStart     bool          // Discard any session on the first connection
+	ReceiveMaximum uint16        // Unacknowledged QoS>0 messages from the broker, optional
+	ConnectTimeout time.Duration // Also bounds subscribing and publishing, optional
 }
 
 type mqttclient struct {
-	log               shared.LoggerIF
-	autopahoConf      autopaho.ClientConfig
-	connMan           *autopaho.ConnectionManager
-	subscriptionsMu   sync.Mutex
-	subscriptions     subscriptionsMu
-	subscriptionOutCh chan shared.MqttData
-	done              chan struct{}
-	connectionOk      connectionStatusMu
-	stopped           bool
+	log             shared.LoggerIF
+	autopahoConf    autopaho.ClientConfig
+	connMan         *autopaho.ConnectionManager
+	subscriptionsMu sync.Mutex
+	subscriptions   subscriptionsMu
+	done            chan struct{}
+	timeout         time.Duration
+	connectionOk    connectionStatusMu
+	stopped         bool
+	droppedAcks     atomic.Uint64
 }
 
 type subscriptionsMu struct {
 	sync.RWMutex
-	subs []paho.SubscribeOptions
+	subs   []subscription
+	nextID int
+	subIDs bool // Broker supports subscription identifiers
+}
+
+/*
+ * Subscriptions to the same filter share one broker subscription and thus
+ * one subscription identifier, at the highest QoS any of them requested
+ */
+type subscription struct {
+	id    int
+	qos   byte
+	opts  paho.SubscribeOptions
+	queue *queue.Queue[shared.MqttData]
 }
 
 type connectionStatusMu struct {
@@ -50,6 +81,8 @@ type connectionStatusMu struct {
 
 const cSCHEME_MQTTS = "mqtts"
 const cSCHEME_TLS = "tls"
+const cSHARED_SUB_PREFIX = "$share/"
+const cMAX_QOS = 2
 
 func Create(conf Conf) (*mqttclient, error) {
 	newClient := new(mqttclient)
@@ -64,13 +97,39 @@ func Create(conf Conf) (*mqttclient, error) {
 		return nil, errors.New("invalid mqtt url")
 	}
 
-	newClient.subscriptionOutCh = make(chan shared.MqttData, 1024)
+	if conf.ConnectTimeout < 0 {
+		return nil, errors.New("bad mqtt connect timeout")
+	}
+	newClient.timeout = conf.ConnectTimeout
+	if newClient.timeout == 0 {
+		newClient.timeout = c_MQTT_TIMEOUT
+	}
+
+	clientId, err := expandClientId(conf.ClientId, os.Hostname, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if clientId == "" && !conf.CleanStart {
+		newClient.log.Warning("No mqtt client id set, the session can not be resumed after a restart")
+	}
+
+	keepAlive := uint16(c_MQTT_KEEPALIVE)
+	if conf.KeepAlive != nil {
+		keepAlive = *conf.KeepAlive
+	}
+
+	sessionExpiry := uint32(c_MQTT_SESSION_EXPIRY)
+	if conf.SessionExpiry != nil {
+		sessionExpiry = *conf.SessionExpiry
+	}
+
 	newClient.done = make(chan struct{})
 	newClient.subscriptions.Lock()
-	newClient.subscriptions.subs = make([]paho.SubscribeOptions, 0)
+	newClient.subscriptions.subs = make([]subscription, 0)
 	newClient.subscriptions.Unlock()
 
 	pahoCfg := paho.ClientConfig{
+		ClientID:           clientId,
 		OnClientError:      newClient.onClientError,
 		OnServerDisconnect: newClient.onServerDisconnect,
 		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
@@ -80,14 +139,25 @@ func Create(conf Conf) (*mqttclient, error) {
 
 	newClient.autopahoConf = autopaho.ClientConfig{
 		ServerUrls:                    []*url.URL{mqttUrl},
-		KeepAlive:                     20,
-		CleanStartOnInitialConnection: false,
-		SessionExpiryInterval:         500,
+		KeepAlive:                     keepAlive,
+		CleanStartOnInitialConnection: conf.CleanStart,
+		SessionExpiryInterval:         sessionExpiry,
 		OnConnectionUp:                newClient.onConnectionUp,
 		OnConnectError:                newClient.onConnectError,
 		ClientConfig:                  pahoCfg,
 	}
 
+	if conf.ReceiveMaximum != 0 {
+		receiveMaximum := conf.ReceiveMaximum
+		newClient.autopahoConf.ConnectPacketBuilder = func(cp *paho.Connect, u *url.URL) (*paho.Connect, error) {
+			if cp.Properties == nil {
+				cp.Properties = new(paho.ConnectProperties)
+			}
+			cp.Properties.ReceiveMaximum = &receiveMaximum
+			return cp, nil
+		}
+	}
+
 	if mqttUrl.Scheme == cSCHEME_MQTTS || mqttUrl.Scheme == cSCHEME_TLS {
 		caCertPool := x509.NewCertPool()
 		cert, err := os.ReadFile(conf.MqttCaCert)
@@ -124,7 +194,7 @@ func (c *mqttclient) Connect() error {
 
 	c.connMan = mqttConnM
 
-	ctx, cancel := context.WithTimeout(context.Background(), c_MQTT_TIMEOUT*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	err = mqttConnM.AwaitConnection(ctx)
 	cancel()
 	if err != nil {
@@ -155,27 +225,117 @@ func (c *mqttclient) subscriptionCb(pr paho.PublishReceived) (bool, error) {
 		Topic:   pr.Packet.Topic,
 	}
 
-	go func() {
-		select {
-		case c.subscriptionOutCh <- outgoingMsg:
+	/*
+	 * Route by subscription identifier, or by topic without one. A topic
+	 * matching several filters is ambiguous: the broker may send a copy per
+	 * subscription, or a single copy with all their identifiers of which paho
+	 * keeps only the last (MQTT 5 §3.3.4). Such messages go to every matching
+	 * subscription, duplicating them with brokers that send copies.
+	 */
+	var subID *int
+	if pr.Packet.Properties != nil {
+		subID = pr.Packet.Properties.SubscriptionIdentifier
+	}
+
+	c.subscriptions.RLock()
+	matching := make([]*queue.Queue[shared.MqttData], 0, 1)
+	byID := make([]*queue.Queue[shared.MqttData], 0, 1)
+	filters := make([]int, 0, 1)
+	for _, s := range c.subscriptions.subs {
+		if topicMatchesFilter(s.opts.Topic, pr.Packet.Topic) {
+			matching = append(matching, s.queue)
+			if !slices.Contains(filters, s.id) {
+				filters = append(filters, s.id)
+			}
+		}
+		if subID != nil && s.id == *subID {
+			byID = append(byID, s.queue)
+		}
+	}
+	c.subscriptions.RUnlock()
+
+	if subID != nil && len(filters) <= 1 {
+		matching = byID
+	}
+
+	if len(matching) == 0 {
+		c.log.Warning("No subscription matches topic '%s', dropping packet", pr.Packet.Topic)
+		return true, nil
+	}
+
+	/* Only with the "block" policy, this may stall all subscriptions */
+	for _, q := range matching {
+		ok := q.Push(outgoingMsg)
+		if ok {
 			c.log.Debug("Successfully handled packet on topic '%s'", pr.Packet.Topic)
-		case <-c.done:
-			c.log.Warning("Shutdown signaled, dropping incoming mqtt packet")
-			return
+		} else if pr.Packet.QoS > 0 {
+			c.droppedAcked(pr.Packet.Topic, pr.Packet.QoS)
 		}
-	}()
+	}
 
 	return true, nil
 }
 
-func (c *mqttclient) Subscribe(topic string) (<-chan shared.MqttData, error) {
-	subscription := paho.SubscribeOptions{
-		Topic: topic,
-		QoS:   0,
+/* Messages are acknowledged once the callback returns, even if dropped */
+func (c *mqttclient) droppedAcked(topic string, qos byte) {
+	n := c.droppedAcks.Add(1)
+
+	if n == 1 || n%cDROPPED_ACKED_LOG_INTERVAL == 0 {
+		c.log.Warning("Dropped QoS %d message on '%s' is still acknowledged to the broker, %d in total", qos, topic, n)
+	} else {
+		c.log.Debug("Dropped QoS %d message on '%s' is still acknowledged to the broker, %d in total", qos, topic, n)
+	}
+}
+
+func (c *mqttclient) Subscribe(topic string, qos byte, queueConf shared.QueueConf) (<-chan shared.MqttData, error) {
+	if qos > cMAX_QOS {
+		return nil, errors.New("invalid mqtt qos")
+	}
+
+	if !queueConf.IsValid() {
+		return nil, errors.New("invalid queue configuration")
+	}
+
+	/*
+	 * The receive callback serves every subscription and keepalives, so by
+	 * default it never waits for a full queue
+	 */
+	if queueConf.Overflow == "" {
+		queueConf.Overflow = c_MQTT_DEFAULT_OVERFLOW
+	} else if queueConf.Overflow == shared.OVERFLOW_BLOCK {
+		c.log.Warning("A full queue for topic '%s' will stall all MQTT subscriptions", topic)
+	}
+
+	subscription := subscription{
+		qos: qos,
+		opts: paho.SubscribeOptions{
+			Topic: topic,
+			QoS:   qos,
+		},
+		queue: queue.New[shared.MqttData](c.log, topic, queueConf, c.done),
 	}
 
 	c.subscriptions.Lock()
+	needSubscribe := true
+	for _, s := range c.subscriptions.subs {
+		if s.opts.Topic == topic {
+			subscription.id = s.id
+			subscription.opts.QoS = max(s.opts.QoS, qos)
+			needSubscribe = qos > s.opts.QoS
+			break
+		}
+	}
+	for _, s := range c.subscriptions.subs {
+		if s.opts.Topic != topic && filtersOverlap(s.opts.Topic, topic) {
+			c.log.Warning("Topic '%s' overlaps '%s', messages matching both may be duplicated", topic, s.opts.Topic)
+		}
+	}
+	if subscription.id == 0 {
+		c.subscriptions.nextID++
+		subscription.id = c.subscriptions.nextID
+	}
 	c.subscriptions.subs = append(c.subscriptions.subs, subscription)
+	c.setFilterQos(topic, subscription.opts.QoS)
 	c.subscriptions.Unlock()
 
 	c.log.Info("Topic '%s' added to pending subscriptions", topic)
@@ -184,39 +344,122 @@ func (c *mqttclient) Subscribe(topic string) (<-chan shared.MqttData, error) {
 	connectionOk := c.connectionOk.ok
 	c.connectionOk.RUnlock()
 
-	if connectionOk {
+	if !needSubscribe {
+		c.log.Info("Already subscribed to '%s' with QoS %d", topic, subscription.opts.QoS)
+	} else if connectionOk {
 		c.log.Info("Will attempt to subscribe to '%s'", topic)
-		sub := paho.Subscribe{
-			Subscriptions: []paho.SubscribeOptions{subscription},
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), c_MQTT_TIMEOUT*time.Second)
-		_, err := c.connMan.Subscribe(ctx, &sub)
-		cancel()
+		err := c.subscribe(subscription)
 		if err != nil {
 			c.log.Warning("Failed to subscribe to topic '%s': %s", topic, err)
 			c.log.Info("Will attempt to subscribe again once connection is stable")
 		}
 	}
 
-	return c.subscriptionOutCh, nil
+	return subscription.queue.C(), nil
+}
+
+/* Called with the subscriptions locked */
+func (c *mqttclient) setFilterQos(topic string, qos byte) {
+	for i := range c.subscriptions.subs {
+		if c.subscriptions.subs[i].opts.Topic == topic {
+			c.subscriptions.subs[i].opts.QoS = qos
+		}
+	}
+}
+
+/* One SUBSCRIBE per filter, as there is one identifier per packet */
+func (c *mqttclient) subscribe(s subscription) error {
+	sub := paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{s.opts},
+	}
+
+	c.subscriptions.RLock()
+	subIDs := c.subscriptions.subIDs
+	c.subscriptions.RUnlock()
+	if subIDs {
+		id := s.id
+		sub.Properties = &paho.SubscribeProperties{SubscriptionIdentifier: &id}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	suback, err := c.connMan.Subscribe(ctx, &sub)
+	cancel()
+	if err != nil {
+		return err
+	}
+	c.checkGrantedQos(sub.Subscriptions, suback)
+
+	return nil
+}
+
+/*
+ * Stop delivering to a channel returned by Subscribe and close it. The broker
+ * subscription is only removed once no other subscriber uses the topic.
+ */
+func (c *mqttclient) Unsubscribe(ch <-chan shared.MqttData) error {
+	c.subscriptions.Lock()
+	idx := slices.IndexFunc(c.subscriptions.subs, func(s subscription) bool {
+		return s.queue.C() == ch
+	})
+	if idx < 0 {
+		c.subscriptions.Unlock()
+		return errors.New("no such subscription")
+	}
+	s := c.subscriptions.subs[idx]
+	c.subscriptions.subs = slices.Delete(c.subscriptions.subs, idx, idx+1)
+	inUse := false
+	remainingQos := byte(0)
+	for _, other := range c.subscriptions.subs {
+		if other.opts.Topic == s.opts.Topic {
+			inUse = true
+			remainingQos = max(remainingQos, other.qos)
+		}
+	}
+	downgrade := inUse && remainingQos < s.opts.QoS
+	if downgrade {
+		c.setFilterQos(s.opts.Topic, remainingQos)
+	}
+	c.subscriptions.Unlock()
+
+	if downgrade && c.CheckConnection() {
+		s.opts.QoS = remainingQos
+		err := c.subscribe(s)
+		if err != nil {
+			c.log.Warning("Failed to lower QoS of topic '%s': %s", s.opts.Topic, err)
+		}
+	} else if !inUse && c.CheckConnection() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		_, err := c.connMan.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{s.opts.Topic}})
+		cancel()
+		if err != nil {
+			c.log.Warning("Failed to unsubscribe from topic '%s': %s", s.opts.Topic, err)
+		}
+	}
+
+	s.queue.Close()
+	c.log.Info("Unsubscribed from topic '%s'", s.opts.Topic)
+
+	return nil
 }
 
 func (c *mqttclient) Stop() {
 	if c.stopped {
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), c_MQTT_TIMEOUT*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 
 	c.subscriptions.RLock()
-	subsCopy := make([]paho.SubscribeOptions, len(c.subscriptions.subs))
+	subsCopy := make([]subscription, len(c.subscriptions.subs))
 	copy(subsCopy, c.subscriptions.subs)
 	c.subscriptions.RUnlock()
 
 	unsub := new(paho.Unsubscribe)
 
 	for _, s := range subsCopy {
-		unsub.Topics = append(unsub.Topics, s.Topic)
+		if !slices.Contains(unsub.Topics, s.opts.Topic) {
+			unsub.Topics = append(unsub.Topics, s.opts.Topic)
+		}
 	}
 
 	if len(unsub.Topics) > 0 && c.connMan != nil {
@@ -232,53 +475,75 @@ func (c *mqttclient) Stop() {
 
 	close(c.done)
 	time.Sleep(10 * time.Millisecond)
-	close(c.subscriptionOutCh)
+	for _, s := range subsCopy {
+		s.queue.Close()
+	}
 
 	c.stopped = true
 }
 
-func (c *mqttclient) StartPublishing(topic string, retain bool) (chan<- []byte, error) {
-	dataChan := make(chan []byte, 1024)
+func (c *mqttclient) StartPublishing(topic string, retain bool, qos byte) (chan<- shared.MqttData, error) {
+	dataChan := make(chan shared.MqttData, 1024)
 
 	if c.connMan == nil {
 		return nil, errors.New("mqtt client must connect first")
 	}
 
+	if qos > cMAX_QOS {
+		return nil, errors.New("invalid mqtt qos")
+	}
+
 	go func() {
 		for data := range dataChan {
 			var err error
 
+			msgTopic := topic
+			if data.Topic != "" {
+				msgTopic = data.Topic
+			}
+
 			mqttMsg := paho.Publish{
-				QoS:     0, // TODO make configurable?
-				Topic:   topic,
-				Payload: data,
+				QoS:     qos,
+				Topic:   msgTopic,
+				Payload: data.Payload,
 				Retain:  retain,
 			}
 
-			c.log.Debug("Attempting to publish on topic '%s'", topic)
+			c.log.Debug("Attempting to publish on topic '%s'", msgTopic)
 
-			ctx, cancel := context.WithTimeout(context.Background(), c_MQTT_TIMEOUT*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 			err = c.connMan.AwaitConnection(ctx)
 			if err != nil {
 				c.log.Error("Error while awaiting MQTT connection")
 				cancel()
+				if data.Done != nil {
+					data.Done(err)
+				}
 				continue
 			}
 
-			_, err = c.connMan.Publish(ctx, &mqttMsg)
+			pubResp, err := c.connMan.Publish(ctx, &mqttMsg)
 
 			if err != nil {
-				c.log.Error("Error '%s' while publishing on topic '%s'", err, topic)
+				if pubResp != nil {
+					c.log.Error("Error '%s' while publishing on topic '%s', reason code: %d", err, msgTopic, pubResp.ReasonCode)
+				} else {
+					c.log.Error("Error '%s' while publishing on topic '%s'", err, msgTopic)
+				}
 			} else {
-				c.log.Debug("Successfully published %d bytes on MQTT topic '%s'", len(mqttMsg.Payload), topic)
+				c.log.Debug("Successfully published %d bytes on MQTT topic '%s'", len(mqttMsg.Payload), msgTopic)
 			}
 			cancel()
+
+			if data.Done != nil {
+				data.Done(err)
+			}
 		}
 
 		c.log.Warning("Publishing channel closed for topic '%s'", topic)
 	}()
 
-	c.log.Info("Will be publishing on MQTT topic '%s', retain: %t", topic, retain)
+	c.log.Info("Will be publishing on MQTT topic '%s', retain: %t, qos: %d", topic, retain, qos)
 
 	return dataChan, nil
 }
@@ -317,22 +582,28 @@ func (c *mqttclient) onServerDisconnect(d *paho.Disconnect) {
 func (c *mqttclient) onConnectionUp(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 	c.log.Info("connection came up, will subscribe")
 
-	c.subscriptions.RLock()
-	subsCopy := make([]paho.SubscribeOptions, len(c.subscriptions.subs))
-	copy(subsCopy, c.subscriptions.subs)
-	c.subscriptions.RUnlock()
-
-	if len(subsCopy) != 0 {
-		sub := paho.Subscribe{
-			Subscriptions: subsCopy,
+	c.subscriptions.Lock()
+	subIDs := connAck.Properties == nil || connAck.Properties.SubIDAvailable
+	c.subscriptions.subIDs = subIDs
+	subsCopy := make([]subscription, 0, len(c.subscriptions.subs))
+	for _, s := range c.subscriptions.subs {
+		if !slices.ContainsFunc(subsCopy, func(other subscription) bool { return other.id == s.id }) {
+			subsCopy = append(subsCopy, s)
 		}
+	}
+	c.subscriptions.Unlock()
 
-		ctx, cancel := context.WithTimeout(context.Background(), c_MQTT_TIMEOUT*time.Second)
-		_, err := c.connMan.Subscribe(ctx, &sub)
-		cancel()
+	if !subIDs {
+		c.log.Warning("Broker does not support subscription identifiers, overlapping subscriptions may get duplicates")
+	}
+
+	for _, s := range subsCopy {
+		err := c.subscribe(s)
 		if err != nil {
-			c.log.Error("Failed to subscribe on connection-up: %s", err)
+			c.log.Error("Failed to subscribe to '%s' on connection-up: %s", s.opts.Topic, err)
 		}
+	}
+	if len(subsCopy) != 0 {
 		c.log.Info("Subscribed to %d topics when connection came up", len(subsCopy))
 	}
 
@@ -343,9 +614,121 @@ func (c *mqttclient) onConnectionUp(cm *autopaho.ConnectionManager, connAck *pah
 	c.log.Info("connection up and ready for use!")
 }
 
+/* The broker may grant a lower QoS than requested */
+func (c *mqttclient) checkGrantedQos(subs []paho.SubscribeOptions, suback *paho.Suback) {
+	if suback == nil {
+		return
+	}
+
+	for i, s := range subs {
+		if i >= len(suback.Reasons) {
+			break
+		}
+
+		if suback.Reasons[i] < s.QoS {
+			c.log.Warning("Requested QoS %d for topic '%s' but broker granted %d", s.QoS, s.Topic, suback.Reasons[i])
+		}
+	}
+}
+
 func (c *mqttclient) onConnectError(err error) {
 	c.log.Error("error whilst attempting connection: %s", err)
 	c.connectionOk.Lock()
 	c.connectionOk.ok = false
 	c.connectionOk.Unlock()
 }
+
+/*
+ * Check if a topic name matches a subscription filter according to the MQTT
+ * spec, i.e. with support for the single level ('+') and multi level ('#')
+ * wildcards. Shared subscriptions ("$share/<group>/<filter>") are matched on
+ * their filter part.
+ */
+func topicMatchesFilter(filter, topic string) bool {
+	filter, ok := unshare(filter)
+	if !ok {
+		return false
+	}
+
+	/* Wildcards must not match topics beginning with '$' */
+	if strings.HasPrefix(topic, "$") && len(filter) > 0 && (filter[0] == '+' || filter[0] == '#') {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, f := range filterLevels {
+		if f == "#" {
+			return i == len(filterLevels)-1
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if f != "+" && f != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+/* Check if some topic name could match both subscription filters */
+func filtersOverlap(a, b string) bool {
+	a, okA := unshare(a)
+	b, okB := unshare(b)
+	if !okA || !okB {
+		return false
+	}
+
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	/* Wildcards must not match topics beginning with '$' */
+	if isWildcard(aLevels[0]) && strings.HasPrefix(bLevels[0], "$") ||
+		isWildcard(bLevels[0]) && strings.HasPrefix(aLevels[0], "$") {
+		return false
+	}
+
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+
+	/* A trailing '#' also matches its parent level */
+	switch {
+	case len(aLevels) == len(bLevels):
+		return true
+	case len(aLevels) == len(bLevels)+1:
+		return aLevels[len(bLevels)] == "#"
+	case len(bLevels) == len(aLevels)+1:
+		return bLevels[len(aLevels)] == "#"
+	}
+
+	return false
+}
+
+/* The filter part of a shared subscription ("$share/<group>/<filter>") */
+func unshare(filter string) (string, bool) {
+	if !strings.HasPrefix(filter, cSHARED_SUB_PREFIX) {
+		return filter, true
+	}
+
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	return parts[2], true
+}
+
+func isWildcard(level string) bool {
+	return level == "+" || level == "#"
+}
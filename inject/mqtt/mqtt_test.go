@@ -0,0 +1,260 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestTopicMatchesFilter(t *testing.T) {
+	var tests = []struct {
+		name     string
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"EXACT", "events/up/node1", "events/up/node1", true},
+		{"EXACT_MISMATCH", "events/up/node1", "events/up/node2", false},
+		{"PLUS", "events/up/+", "events/up/node1", true},
+		{"PLUS_TOO_DEEP", "events/up/+", "events/up/node1/extra", false},
+		{"PLUS_MIDDLE", "events/+/node1", "events/up/node1", true},
+		{"HASH", "events/up/#", "events/up/node1/extra", true},
+		{"HASH_PARENT", "events/up/#", "events/up", true},
+		{"HASH_OTHER", "events/up/#", "events/down/node1", false},
+		{"HASH_ONLY", "#", "events/up/node1", true},
+		{"HASH_DOLLAR", "#", "$SYS/broker", false},
+		{"PLUS_DOLLAR", "+/broker", "$SYS/broker", false},
+		{"SHARED", "$share/group/events/up/+", "events/up/node1", true},
+		{"SHARED_MISMATCH", "$share/group/events/up/+", "events/down/node1", false},
+		{"SHORTER_TOPIC", "events/up/node1", "events/up", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := topicMatchesFilter(tt.filter, tt.topic)
+			if got != tt.expected {
+				t.Fatalf("filter '%s', topic '%s': got %t, expected %t", tt.filter, tt.topic, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFiltersOverlap(t *testing.T) {
+	var tests = []struct {
+		name     string
+		a        string
+		b        string
+		expected bool
+	}{
+		{"EQUAL", "events/up/node1", "events/up/node1", true},
+		{"DIFFERENT", "events/up/node1", "events/up/node2", false},
+		{"PLUS", "events/up/+", "events/up/node1", true},
+		{"PLUS_BOTH", "events/+/node1", "events/up/+", true},
+		{"PLUS_DEPTH", "events/up/+", "events/up/node1/extra", false},
+		{"HASH", "events/#", "events/+/x", true},
+		{"HASH_PARENT", "events/up/#", "events/up", true},
+		{"HASH_OTHER", "events/up/#", "events/down/+", false},
+		{"HASH_DOLLAR", "#", "$SYS/broker", false},
+		{"PLUS_DOLLAR", "$SYS/+", "+/broker", false},
+		{"SHARED", "$share/group/events/up/+", "events/+/node1", true},
+		{"SHARED_MISMATCH", "$share/group/events/up/+", "events/down/node1", false},
+		{"SHORTER", "events/up", "events/up/node1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, f := range [][2]string{{tt.a, tt.b}, {tt.b, tt.a}} {
+				got := filtersOverlap(f[0], f[1])
+				if got != tt.expected {
+					t.Fatalf("filters '%s' and '%s': got %t, expected %t", f[0], f[1], got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandClientId(t *testing.T) {
+	var tests = []struct {
+		name     string
+		tmpl     string
+		hostname string
+		env      string
+		expected string
+		valid    bool
+	}{
+		{"PLAIN", "bridge-1", "host", "", "bridge-1", true},
+		{"EMPTY", "", "host", "", "", true},
+		{"HOSTNAME", "bridge-{hostname}", "host", "", "bridge-host", true},
+		{"REPLICA_FROM_HOSTNAME", "bridge-{replica}", "mqtt-bridge-2", "", "bridge-2", true},
+		{"REPLICA_FROM_ENV", "{hostname}/{replica}", "host", "7", "host/7", true},
+		{"NO_REPLICA", "bridge-{replica}", "host", "", "", false},
+		{"NO_ORDINAL", "bridge-{replica}", "mqtt-bridge-x", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostname := func() (string, error) {
+				return tt.hostname, nil
+			}
+			lookupEnv := func(name string) (string, bool) {
+				return tt.env, tt.env != ""
+			}
+
+			got, err := expandClientId(tt.tmpl, hostname, lookupEnv)
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error '%v', expected valid: %t", err, tt.valid)
+			}
+			if got != tt.expected {
+				t.Fatalf("Got client id '%s', expected '%s'", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSessionParameters(t *testing.T) {
+	zeroKeepAlive := uint16(0)
+	zeroSessionExpiry := uint32(0)
+
+	var tests = []struct {
+		name              string
+		keepAlive         *uint16
+		sessionExpiry     *uint32
+		wantKeepAlive     uint16
+		wantSessionExpiry uint32
+	}{
+		{"DEFAULT", nil, nil, c_MQTT_KEEPALIVE, c_MQTT_SESSION_EXPIRY},
+		{"ZERO", &zeroKeepAlive, &zeroSessionExpiry, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := Create(Conf{
+				Log:           fake.Logger(),
+				MqttUrl:       "mqtt://localhost:1883",
+				CleanStart:    true,
+				KeepAlive:     tt.keepAlive,
+				SessionExpiry: tt.sessionExpiry,
+			})
+			if err != nil {
+				t.Fatalf("Error creating client: %s", err)
+			}
+
+			if client.autopahoConf.KeepAlive != tt.wantKeepAlive {
+				t.Fatalf("Got keepalive %d, expected %d", client.autopahoConf.KeepAlive, tt.wantKeepAlive)
+			}
+			if client.autopahoConf.SessionExpiryInterval != tt.wantSessionExpiry {
+				t.Fatalf("Got session expiry %d, expected %d", client.autopahoConf.SessionExpiryInterval, tt.wantSessionExpiry)
+			}
+		})
+	}
+}
+
+func TestSubscriptionRouting(t *testing.T) {
+	client, err := Create(Conf{Log: fake.Logger(), MqttUrl: "mqtt://localhost:1883", CleanStart: true})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	/* Overlapping filters, "events/a/x" matches both */
+	all, err := client.Subscribe("events/#", 0, shared.QueueConf{})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	some, err := client.Subscribe("events/+/x", 0, shared.QueueConf{})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	if all == some {
+		t.Fatalf("Subscriptions share a channel")
+	}
+
+	var tests = []struct {
+		name   string
+		subID  int
+		topic  string
+		toAll  bool
+		toSome bool
+	}{
+		{"ID_ONE_MATCH", 1, "events/a/y", true, false},
+		{"ID_BOTH_MATCH", 1, "events/a/x", true, true},
+		{"OTHER_ID_BOTH_MATCH", 2, "events/a/x", true, true},
+		{"NO_ID_BOTH_MATCH", 0, "events/a/x", true, true},
+		{"NO_ID_ONE_MATCH", 0, "events/a/y", true, false},
+		{"UNKNOWN_ID", 3, "events/a/y", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := &paho.Publish{Topic: tt.topic, Payload: []byte(tt.name)}
+			if tt.subID != 0 {
+				id := tt.subID
+				pub.Properties = &paho.PublishProperties{SubscriptionIdentifier: &id}
+			}
+
+			_, err := client.subscriptionCb(paho.PublishReceived{Packet: pub})
+			if err != nil {
+				t.Fatalf("Error in callback: %s", err)
+			}
+
+			for _, ch := range []struct {
+				c    <-chan shared.MqttData
+				want bool
+			}{{all, tt.toAll}, {some, tt.toSome}} {
+				select {
+				case data := <-ch.c:
+					if !ch.want || string(data.Payload) != tt.name {
+						t.Fatalf("Unexpected message '%s'", data.Payload)
+					}
+				default:
+					if ch.want {
+						t.Fatalf("Message not delivered")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionSameFilterQos(t *testing.T) {
+	client, err := Create(Conf{Log: fake.Logger(), MqttUrl: "mqtt://localhost:1883", CleanStart: true})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+
+	filterQos := func() []byte {
+		qos := make([]byte, 0)
+		for _, s := range client.subscriptions.subs {
+			if s.id != client.subscriptions.subs[0].id {
+				t.Fatalf("Same filter with different subscription identifiers")
+			}
+			qos = append(qos, s.opts.QoS)
+		}
+		return qos
+	}
+
+	_, err = client.Subscribe("events/#", 0, shared.QueueConf{})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+	high, err := client.Subscribe("events/#", 2, shared.QueueConf{})
+	if err != nil {
+		t.Fatalf("Error subscribing: %s", err)
+	}
+
+	/* One broker subscription with the highest QoS requested */
+	if qos := filterQos(); len(qos) != 2 || qos[0] != 2 || qos[1] != 2 {
+		t.Fatalf("Got filter QoS %v, expected 2 for both", qos)
+	}
+
+	err = client.Unsubscribe(high)
+	if err != nil {
+		t.Fatalf("Error unsubscribing: %s", err)
+	}
+
+	if qos := filterQos(); len(qos) != 1 || qos[0] != 0 {
+		t.Fatalf("Got filter QoS %v, expected 0 after unsubscribing", qos)
+	}
+}
@@ -1,31 +1,59 @@
 package nats
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"github.com/dnstapir/mqtt-bridge/inject/queue"
 	"github.com/dnstapir/mqtt-bridge/shared"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"slices"
+	"sync"
 	"time"
 )
 
+const cJS_PUBLISH_TIMEOUT = 5 * time.Second
+const cJS_BACKOFF_MIN = 100 * time.Millisecond
+const cJS_BACKOFF_MAX = 10 * time.Second
+
+/* Bounds waiting for messages in flight when stopping */
+const cDRAIN_TIMEOUT = 5 * time.Second
+
 type Conf struct {
 	Log     shared.LoggerIF
 	NatsUrl string
 }
 
 type natsclient struct {
-	url               string
-	log               shared.LoggerIF
-	conn              *nats.Conn
-	subscriptionOutCh chan []byte
-	done              chan struct{}
-	sub               *nats.Subscription
+	url           string
+	log           shared.LoggerIF
+	conn          *nats.Conn
+	js            jetstream.JetStream
+	done          chan struct{}
+	closed        chan struct{}
+	subscriptions subscriptionsMu
+}
+
+type subscriptionsMu struct {
+	sync.Mutex
+	subs []subscription
+}
+
+type subscription struct {
+	sub     *nats.Subscription
+	consCtx jetstream.ConsumeContext
+	queue   *queue.Queue[shared.NatsData]
 }
 
 func Create(conf Conf) (*natsclient, error) {
 	newClient := new(natsclient)
 
-	newClient.subscriptionOutCh = make(chan []byte, 1024)
 	newClient.done = make(chan struct{})
+	newClient.closed = make(chan struct{})
+	newClient.subscriptions.subs = make([]subscription, 0)
 
 	newClient.url = conf.NatsUrl
 	newClient.log = conf.Log
@@ -38,48 +66,190 @@ func (c *natsclient) Connect() error {
 		return errors.New("already has connection")
 	}
 
-	natsConn, err := nats.Connect(c.url)
+	natsConn, err := nats.Connect(c.url, nats.ClosedHandler(func(*nats.Conn) {
+		close(c.closed)
+	}))
 
 	if err != nil {
 		return err
 	}
 	c.conn = natsConn
 
+	js, err := jetstream.New(natsConn)
+	if err != nil {
+		return err
+	}
+	c.js = js
+
 	return nil
 }
 
-func (c *natsclient) Subscribe(subject string, queue string) (<-chan []byte, error) {
-	sub, err := c.conn.QueueSubscribe(subject, queue, c.subscriptionCb)
+func (c *natsclient) Subscribe(subject string, queueGroup string, queueConf shared.QueueConf) (<-chan shared.NatsData, error) {
+	if c.conn == nil {
+		return nil, errors.New("nats client must connect first")
+	}
+
+	if !queueConf.IsValid() {
+		return nil, errors.New("invalid queue configuration")
+	}
+
+	q := queue.New[shared.NatsData](c.log, subject, queueConf, c.done)
+
+	sub, err := c.conn.QueueSubscribe(subject, queueGroup, func(msg *nats.Msg) {
+		c.subscriptionCb(msg, q)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.subscriptions.Lock()
+	c.subscriptions.subs = append(c.subscriptions.subs, subscription{sub: sub, queue: q})
+	c.subscriptions.Unlock()
+
+	c.log.Debug("Nats subscription to '%s' done", subject)
+
+	return q.C(), nil
+}
+
+/*
+ * Bind to a durable pull consumer on a JetStream stream, creating it with the
+ * given filter subject if it does not exist. An existing consumer must filter
+ * on that subject. Messages carry an acker and must be acknowledged by the
+ * receiver.
+ */
+func (c *natsclient) SubscribeDurable(stream string, consumer string, subject string, queueConf shared.QueueConf) (<-chan shared.NatsData, error) {
+	if c.js == nil {
+		return nil, errors.New("nats client must connect first")
+	}
+
+	if !queueConf.IsValid() {
+		return nil, errors.New("invalid queue configuration")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cJS_PUBLISH_TIMEOUT)
+	defer cancel()
+
+	cons, err := c.js.Consumer(ctx, stream, consumer)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		c.log.Info("Consumer '%s' not found on stream '%s', creating it", consumer, stream)
+		consConf := jetstream.ConsumerConfig{
+			Durable:       consumer,
+			FilterSubject: subject,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+		}
+		cons, err = c.js.CreateOrUpdateConsumer(ctx, stream, consConf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkConsumerFilter(cons.CachedInfo(), subject)
 	if err != nil {
 		return nil, err
 	}
 
-	c.sub = sub
-	c.log.Debug("Nats subscription done")
+	q := queue.New[shared.NatsData](c.log, consumer, queueConf, c.done)
+
+	consCtx, err := cons.Consume(func(msg jetstream.Msg) {
+		c.jsSubscriptionCb(msg, q)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.subscriptions.Lock()
+	c.subscriptions.subs = append(c.subscriptions.subs, subscription{consCtx: consCtx, queue: q})
+	c.subscriptions.Unlock()
+
+	c.log.Debug("Bound to consumer '%s' on stream '%s'", consumer, stream)
+
+	return q.C(), nil
+}
+
+/* Not updated to match, the consumer may be shared with other services */
+func checkConsumerFilter(info *jetstream.ConsumerInfo, subject string) error {
+	filters := info.Config.FilterSubjects
+	if info.Config.FilterSubject != "" {
+		filters = []string{info.Config.FilterSubject}
+	}
+
+	if len(filters) != 1 || filters[0] != subject {
+		return fmt.Errorf("consumer '%s' filters on %v, not on subject '%s'", info.Name, filters, subject)
+	}
 
-	return c.subscriptionOutCh, nil
+	return nil
+}
+
+/*
+ * Stop delivering to a channel returned by Subscribe or SubscribeDurable and
+ * close it. Unacknowledged durable consumer messages are redelivered.
+ */
+func (c *natsclient) Unsubscribe(ch <-chan shared.NatsData) error {
+	c.subscriptions.Lock()
+	idx := slices.IndexFunc(c.subscriptions.subs, func(s subscription) bool {
+		return s.queue.C() == ch
+	})
+	if idx < 0 {
+		c.subscriptions.Unlock()
+		return errors.New("no such subscription")
+	}
+	s := c.subscriptions.subs[idx]
+	c.subscriptions.subs = slices.Delete(c.subscriptions.subs, idx, idx+1)
+	c.subscriptions.Unlock()
+
+	if s.consCtx != nil {
+		s.consCtx.Stop()
+	} else {
+		err := s.sub.Unsubscribe()
+		if err != nil {
+			c.log.Warning("Unsubscribe failed for subject '%s' in nats: %s", s.sub.Subject, err)
+		}
+	}
+
+	s.queue.Close()
+	c.log.Debug("Nats subscription removed")
+
+	return nil
 }
 
 func (c *natsclient) Stop() {
-	if c.sub != nil {
-		err := c.sub.Unsubscribe()
+	c.subscriptions.Lock()
+	subs := c.subscriptions.subs
+	c.subscriptions.subs = nil
+	c.subscriptions.Unlock()
+
+	for _, s := range subs {
+		if s.consCtx != nil {
+			s.consCtx.Drain()
+			continue
+		}
+
+		err := s.sub.Drain()
 		if err != nil {
-			c.log.Warning("Unsubscribe failed in nats: %s", err)
+			c.log.Warning("Drain failed for subscription '%s' in nats: %s", s.sub.Subject, err)
 		}
-		c.sub = nil
 	}
 
+	/* Draining is asynchronous, messages in flight are pushed until closed */
 	if c.conn != nil {
 		err := c.conn.Drain()
 		if err != nil {
 			c.log.Warning("Drain failed in nats: %s", err)
+		} else {
+			select {
+			case <-c.closed:
+			case <-time.After(cDRAIN_TIMEOUT):
+				c.log.Warning("Timed out draining nats connection")
+			}
 		}
 		c.conn = nil
+		c.js = nil
 	}
 
 	close(c.done)
-	time.Sleep(10 * time.Millisecond)
-	close(c.subscriptionOutCh)
+	for _, s := range subs {
+		s.queue.Close()
+	}
 }
 
 func (c *natsclient) StartPublishing(subject string, queue string) (chan<- shared.NatsData, error) {
@@ -87,41 +257,163 @@ func (c *natsclient) StartPublishing(subject string, queue string) (chan<- share
 
 	go func() {
 		for natsData := range dataChan {
-			msg := nats.NewMsg(subject)
-			msg.Data = natsData.Payload
-
-			for _, h := range shared.NATSHEADERS_DNSTAPIR_ALL {
-				val, ok := natsData.Headers[h]
-				if ok {
-					msg.Header.Add(h, val)
-					c.log.Debug("Setting NATS header, '%s: %s'", h, val)
-				}
-			}
+			msg := c.buildMsg(subject, natsData)
 
 			c.log.Debug("Attempting to publish NATS message %s", string(msg.Data))
 			err := c.conn.PublishMsg(msg)
 			if err != nil {
-				c.log.Error("Failed to publish NATS message on subject '%s'", subject)
+				c.log.Error("Failed to publish NATS message on subject '%s'", msg.Subject)
 			}
-			c.log.Debug("Published NATS message to subject %s!", subject)
+			c.log.Debug("Published NATS message to subject %s!", msg.Subject)
 		}
 	}()
 
 	return dataChan, nil
 }
 
-func (c *natsclient) subscriptionCb(msg *nats.Msg) {
-	c.log.Debug("Received nats message %s", string(msg.Data))
+/*
+ * Publish to a JetStream stream, retrying with backoff until the message has
+ * been acknowledged. The message ID is used by the stream for deduplication
+ * so retries never result in duplicates. Closing stop ends the retries,
+ * dropping the messages not yet published.
+ */
+func (c *natsclient) StartJetStreamPublishing(subject string, stop <-chan struct{}) (chan<- shared.NatsData, error) {
+	if c.js == nil {
+		return nil, errors.New("nats client must connect first")
+	}
+
+	dataChan := make(chan shared.NatsData, 1024)
 
 	go func() {
+		for natsData := range dataChan {
+			msg := c.buildMsg(subject, natsData)
+
+			msgID := natsData.MsgID
+			if msgID == "" {
+				sum := sha256.Sum256(natsData.Payload)
+				msgID = hex.EncodeToString(sum[:])
+			}
+
+			ok := c.publishUntilAcked(msg, msgID, stop)
+			if !ok {
+				c.log.Warning("Publishing stopped, dropping unacknowledged NATS message '%s'", msgID)
+				return
+			}
+		}
+
+		c.log.Warning("JetStream publishing channel closed for subject '%s'", subject)
+	}()
+
+	c.log.Info("Will be publishing to JetStream on subject '%s'", subject)
+
+	return dataChan, nil
+}
+
+func (c *natsclient) publishUntilAcked(msg *nats.Msg, msgID string, stop <-chan struct{}) bool {
+	backoff := cJS_BACKOFF_MIN
+
+	for {
 		select {
-		case c.subscriptionOutCh <- msg.Data:
-			c.log.Debug("Succesfully handled packet on subject '%s'", msg.Subject)
 		case <-c.done:
-			c.log.Warning("Shutdown signaled, aborting handling of incoming nats message")
-			return
+			return false
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cJS_PUBLISH_TIMEOUT)
+		ack, err := c.js.PublishMsg(ctx, msg, jetstream.WithMsgID(msgID))
+		cancel()
+		if err == nil {
+			if ack.Duplicate {
+				c.log.Debug("JetStream message '%s' was a duplicate", msgID)
+			}
+			c.log.Debug("Published JetStream message '%s' to stream '%s', seq %d", msgID, ack.Stream, ack.Sequence)
+			return true
+		}
+
+		c.log.Warning("Failed to publish JetStream message '%s' on subject '%s', retrying in %s: %s", msgID, msg.Subject, backoff, err)
+
+		select {
+		case <-c.done:
+			return false
+		case <-stop:
+			return false
+		case <-time.After(backoff):
 		}
-	}()
+
+		backoff = min(2*backoff, cJS_BACKOFF_MAX)
+	}
+}
+
+func (c *natsclient) buildMsg(subject string, natsData shared.NatsData) *nats.Msg {
+	msgSubject := subject
+	if natsData.Subject != "" {
+		msgSubject = natsData.Subject
+	}
+	msg := nats.NewMsg(msgSubject)
+	msg.Data = natsData.Payload
+	msg.Reply = natsData.Reply
+
+	for _, h := range shared.NATSHEADERS_DNSTAPIR_ALL {
+		val, ok := natsData.Headers[h]
+		if ok {
+			msg.Header.Add(h, val)
+			c.log.Debug("Setting NATS header, '%s: %s'", h, val)
+		}
+	}
+
+	return msg
+}
+
+/* Depending on overflow policy, this may block the subscription */
+func (c *natsclient) subscriptionCb(msg *nats.Msg, q *queue.Queue[shared.NatsData]) {
+	c.log.Debug("Received nats message %s", string(msg.Data))
+
+	incomingMsg := toNatsData(msg)
+
+	ok := q.Push(incomingMsg)
+	if ok {
+		c.log.Debug("Succesfully handled packet on subject '%s'", msg.Subject)
+	}
 
 	c.log.Debug("Done processing nats message")
 }
+
+/* Dropped messages are left unacknowledged and will be redelivered */
+func (c *natsclient) jsSubscriptionCb(msg jetstream.Msg, q *queue.Queue[shared.NatsData]) {
+	c.log.Debug("Received JetStream message %s", string(msg.Data()))
+
+	incomingMsg := shared.NatsData{
+		Subject: msg.Subject(),
+		Headers: make(map[string]string, len(msg.Headers())),
+		Payload: msg.Data(),
+		Acker:   msg,
+	}
+
+	for h := range msg.Headers() {
+		incomingMsg.Headers[h] = msg.Headers().Get(h)
+	}
+
+	ok := q.Push(incomingMsg)
+	if ok {
+		c.log.Debug("Succesfully handled JetStream message on subject '%s'", msg.Subject())
+	}
+}
+
+/*
+ * Only the first value of each header is kept, multiple values for the same
+ * header are not used by any bridge
+ */
+func toNatsData(msg *nats.Msg) shared.NatsData {
+	natsData := shared.NatsData{
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Headers: make(map[string]string, len(msg.Header)),
+		Payload: msg.Data,
+	}
+
+	for h := range msg.Header {
+		natsData.Headers[h] = msg.Header.Get(h)
+	}
+
+	return natsData
+}
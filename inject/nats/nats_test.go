@@ -0,0 +1,229 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func TestToNatsData(t *testing.T) {
+	msg := nats.NewMsg("observations.down.edge1")
+	msg.Reply = "_INBOX.reply"
+	msg.Data = []byte("{\"foo\": \"bar\"}")
+	msg.Header.Add(shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC, "observations/down/edge1")
+	msg.Header.Add("Custom-Header", "first")
+	msg.Header.Add("Custom-Header", "second")
+
+	got := toNatsData(msg)
+
+	if got.Subject != msg.Subject {
+		t.Fatalf("got subject %s, expected %s", got.Subject, msg.Subject)
+	}
+	if got.Reply != msg.Reply {
+		t.Fatalf("got reply %s, expected %s", got.Reply, msg.Reply)
+	}
+	if string(got.Payload) != string(msg.Data) {
+		t.Fatalf("got payload %s, expected %s", got.Payload, msg.Data)
+	}
+	if got.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC] != "observations/down/edge1" {
+		t.Fatalf("got topic header %s", got.Headers[shared.NATSHEADER_DNSTAPIR_MQTT_TOPIC])
+	}
+	if got.Headers["Custom-Header"] != "first" {
+		t.Fatalf("got custom header %s, expected first", got.Headers["Custom-Header"])
+	}
+}
+
+func TestCheckConsumerFilter(t *testing.T) {
+	var tests = []struct {
+		name    string
+		filter  string
+		filters []string
+		valid   bool
+	}{
+		{"SAME", "observations.down", nil, true},
+		{"SAME_IN_LIST", "", []string{"observations.down"}, true},
+		{"OTHER", "observations.up", nil, false},
+		{"NONE", "", nil, false},
+		{"SEVERAL", "", []string{"observations.down", "observations.up"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &jetstream.ConsumerInfo{
+				Name: "testconsumer",
+				Config: jetstream.ConsumerConfig{
+					FilterSubject:  tt.filter,
+					FilterSubjects: tt.filters,
+				},
+			}
+
+			err := checkConsumerFilter(info, "observations.down")
+			if (err == nil) != tt.valid {
+				t.Fatalf("Got error '%v', expected valid: %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+/*
+ * Just enough of the NATS protocol for a single client to subscribe, and for
+ * the test to deliver messages to the subscriptions of a subject
+ */
+type testServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	conn     net.Conn
+	subs     map[string]string // sid to subject
+	subbed   chan string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	srv := &testServer{
+		listener: listener,
+		subs:     make(map[string]string),
+		subbed:   make(chan string, 10),
+	}
+	go srv.serve()
+
+	return srv
+}
+
+func (s *testServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *testServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	s.write("INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			s.write("PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			s.subs[fields[len(fields)-1]] = fields[1]
+			s.mu.Unlock()
+			s.subbed <- fields[1]
+		case "UNSUB":
+			s.mu.Lock()
+			delete(s.subs, fields[1])
+			s.mu.Unlock()
+		case "PUB", "HPUB":
+			var size int
+			fmt.Sscan(fields[len(fields)-1], &size)
+			io.CopyN(io.Discard, r, int64(size)+2)
+		}
+	}
+}
+
+func (s *testServer) write(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Write([]byte(data))
+}
+
+func (s *testServer) deliver(subject, payload string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sid, subSubject := range s.subs {
+		if subSubject == subject {
+			fmt.Fprintf(s.conn, "MSG %s %s %d\r\n%s\r\n", subject, sid, len(payload), payload)
+		}
+	}
+}
+
+func TestSubscriptionsSeparateChannels(t *testing.T) {
+	srv := newTestServer(t)
+
+	client, err := Create(Conf{Log: fake.Logger(), NatsUrl: srv.url()})
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+
+	subjects := []string{"subject.a", "subject.b"}
+	chans := make([]<-chan shared.NatsData, 0, len(subjects))
+	for _, subject := range subjects {
+		ch, err := client.Subscribe(subject, "", shared.QueueConf{Size: 10})
+		if err != nil {
+			t.Fatalf("Error subscribing to '%s': %s", subject, err)
+		}
+		chans = append(chans, ch)
+		<-srv.subbed
+	}
+
+	if chans[0] == chans[1] {
+		t.Fatalf("Subscriptions share a channel")
+	}
+
+	for _, subject := range subjects {
+		srv.deliver(subject, "to "+subject)
+	}
+
+	for i, subject := range subjects {
+		select {
+		case got := <-chans[i]:
+			if got.Subject != subject || string(got.Payload) != "to "+subject {
+				t.Fatalf("Subscription to '%s' got message '%s' on '%s'", subject, got.Payload, got.Subject)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No message for subscription to '%s'", subject)
+		}
+	}
+
+	/* Still in flight when stopping, must be drained into the channels */
+	for _, subject := range subjects {
+		srv.deliver(subject, "last to "+subject)
+	}
+
+	client.Stop()
+
+	for i, subject := range subjects {
+		got := make([]string, 0)
+		for msg := range chans[i] {
+			got = append(got, string(msg.Payload))
+		}
+		if len(got) != 1 || got[0] != "last to "+subject {
+			t.Fatalf("Subscription to '%s' got %v after stop, expected the last message only", subject, got)
+		}
+	}
+}
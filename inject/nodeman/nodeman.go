@@ -7,9 +7,12 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/dnstapir/mqtt-bridge/shared"
+
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 type Conf struct {
@@ -18,12 +21,42 @@ type Conf struct {
 }
 
 type nodemanclient struct {
-	log    shared.LoggerIF
-	url    *url.URL
-	client http.Client
+	log     shared.LoggerIF
+	url     *url.URL
+	client  http.Client
+	backoff *lru.Cache[string, backoffState]
+	breaker breaker
+
+	backoffMin      time.Duration
+	backoffMax      time.Duration
+	breakerLimit    int
+	breakerCooldown time.Duration
+}
+
+/* Per key ID, lookups are not retried before "next" */
+type backoffState struct {
+	delay time.Duration
+	next  time.Time
+}
+
+/*
+ * Opens after a number of consecutive failures talking to nodeman. Once the
+ * cooldown has passed a single trial request is let through, closing the
+ * breaker on success.
+ */
+type breaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
 }
 
 const cNODEMAN_NODE_API_FMT = "/node/%s/public_key"
+const cBACKOFF_CACHE_SIZE = 1000
+const cBACKOFF_MIN = 1 * time.Second
+const cBACKOFF_MAX = 5 * time.Minute
+const cBREAKER_LIMIT = 5
+const cBREAKER_COOLDOWN = 30 * time.Second
 
 func Create(conf Conf) (*nodemanclient, error) {
 	newNodeman := new(nodemanclient)
@@ -56,10 +89,46 @@ func Create(conf Conf) (*nodemanclient, error) {
 
 	newNodeman.client = client
 
+	backoff, err := lru.New[string, backoffState](cBACKOFF_CACHE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	newNodeman.backoff = backoff
+
+	newNodeman.backoffMin = cBACKOFF_MIN
+	newNodeman.backoffMax = cBACKOFF_MAX
+	newNodeman.breakerLimit = cBREAKER_LIMIT
+	newNodeman.breakerCooldown = cBREAKER_COOLDOWN
+
 	return newNodeman, nil
 }
 
 func (n *nodemanclient) GetKey(keyID string) ([]byte, error) {
+	state, ok := n.backoff.Get(keyID)
+	if ok && time.Now().Before(state.next) {
+		n.log.Debug("Backing off lookup of key '%s' until %s", keyID, state.next)
+		return nil, fmt.Errorf("%w: backing off key '%s'", shared.ErrNodemanUnavailable, keyID)
+	}
+
+	if !n.breakerAllow() {
+		return nil, fmt.Errorf("%w: circuit breaker open", shared.ErrNodemanUnavailable)
+	}
+
+	body, err := n.getKey(keyID)
+	if err != nil {
+		/* A missing or refused key ID says nothing about the health of nodeman */
+		n.breakerDone(errors.Is(err, shared.ErrNodemanKeyNotFound))
+		n.backOff(keyID, state, ok)
+		return nil, err
+	}
+
+	n.breakerDone(true)
+	n.backoff.Remove(keyID)
+
+	return body, nil
+}
+
+func (n *nodemanclient) getKey(keyID string) ([]byte, error) {
 	req, err := http.NewRequest("GET",
 		n.url.JoinPath(fmt.Sprintf(cNODEMAN_NODE_API_FMT, keyID)).String(),
 		nil)
@@ -74,7 +143,15 @@ func (n *nodemanclient) GetKey(keyID string) ([]byte, error) {
 	}
 	defer rsp.Body.Close()
 
-	if rsp.StatusCode != http.StatusOK {
+	/*
+	 * Client errors other than 429 are about the key ID, which the sender
+	 * chose, and must not open the breaker for everyone. Server errors and
+	 * 429 say nodeman can not be used.
+	 */
+	if rsp.StatusCode >= 400 && rsp.StatusCode < 500 && rsp.StatusCode != http.StatusTooManyRequests {
+		n.log.Warning("nodeman API returned status %d for key '%s'", rsp.StatusCode, keyID)
+		return nil, fmt.Errorf("%w: status %d", shared.ErrNodemanKeyNotFound, rsp.StatusCode)
+	} else if rsp.StatusCode != http.StatusOK {
 		n.log.Error("nodeman API returned status %d", rsp.StatusCode)
 		return nil, errors.New("bad reponse error code")
 	}
@@ -86,3 +163,52 @@ func (n *nodemanclient) GetKey(keyID string) ([]byte, error) {
 
 	return body, nil
 }
+
+func (n *nodemanclient) backOff(keyID string, state backoffState, ok bool) {
+	delay := n.backoffMin
+	if ok {
+		delay = min(2*state.delay, n.backoffMax)
+	}
+
+	n.backoff.Add(keyID, backoffState{delay: delay, next: time.Now().Add(delay)})
+	n.log.Debug("Next lookup of key '%s' in %s", keyID, delay)
+}
+
+func (n *nodemanclient) breakerAllow() bool {
+	n.breaker.Lock()
+	defer n.breaker.Unlock()
+
+	if n.breaker.failures < n.breakerLimit {
+		return true
+	}
+
+	if time.Now().Before(n.breaker.openUntil) || n.breaker.trial {
+		return false
+	}
+
+	n.breaker.trial = true
+	n.log.Info("Circuit breaker half-open, trying nodeman again")
+
+	return true
+}
+
+func (n *nodemanclient) breakerDone(healthy bool) {
+	n.breaker.Lock()
+	defer n.breaker.Unlock()
+
+	n.breaker.trial = false
+
+	if healthy {
+		if n.breaker.failures >= n.breakerLimit {
+			n.log.Info("Circuit breaker closed, nodeman is healthy again")
+		}
+		n.breaker.failures = 0
+		return
+	}
+
+	n.breaker.failures++
+	if n.breaker.failures >= n.breakerLimit {
+		n.breaker.openUntil = time.Now().Add(n.breakerCooldown)
+		n.log.Warning("Circuit breaker open after %d failures, not contacting nodeman until %s", n.breaker.failures, n.breaker.openUntil)
+	}
+}
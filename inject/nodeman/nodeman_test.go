@@ -0,0 +1,150 @@
+package nodeman
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+)
+
+func setup(t *testing.T, status *atomic.Int32, requests *atomic.Int32) *nodemanclient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := Create(Conf{Log: fake.QuietLogger(), NodemanApiUrl: srv.URL})
+	if err != nil {
+		panic(err)
+	}
+	client.backoffMin = 20 * time.Millisecond
+	client.backoffMax = 40 * time.Millisecond
+	client.breakerLimit = 3
+	client.breakerCooldown = 50 * time.Millisecond
+
+	return client
+}
+
+func TestGetKeyBackoff(t *testing.T) {
+	var status, requests atomic.Int32
+	status.Store(http.StatusNotFound)
+	client := setup(t, &status, &requests)
+
+	_, err := client.GetKey("unknown")
+	if !errors.Is(err, shared.ErrNodemanKeyNotFound) {
+		t.Fatalf("got err '%v', expected key not found", err)
+	}
+
+	_, err = client.GetKey("unknown")
+	if !errors.Is(err, shared.ErrNodemanUnavailable) {
+		t.Fatalf("got err '%v', expected backoff", err)
+	}
+
+	/* Other keys are not affected */
+	_, err = client.GetKey("other")
+	if !errors.Is(err, shared.ErrNodemanKeyNotFound) {
+		t.Fatalf("got err '%v', expected key not found", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	status.Store(http.StatusOK)
+	_, err = client.GetKey("unknown")
+	if err != nil {
+		t.Fatalf("got err '%v' after backoff", err)
+	}
+
+	if requests.Load() != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests.Load())
+	}
+}
+
+func TestGetKeyCircuitBreaker(t *testing.T) {
+	var status, requests atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	client := setup(t, &status, &requests)
+
+	keyIDs := []string{"a", "b", "c", "d", "e"}
+	for _, keyID := range keyIDs {
+		_, err := client.GetKey(keyID)
+		if err == nil {
+			t.Fatalf("expected error for key '%s'", keyID)
+		}
+	}
+
+	if requests.Load() != 3 {
+		t.Fatalf("expected breaker to open after 3 requests, got %d", requests.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	status.Store(http.StatusOK)
+
+	_, err := client.GetKey("f")
+	if err != nil {
+		t.Fatalf("got err '%v' after cooldown", err)
+	}
+	_, err = client.GetKey("g")
+	if err != nil {
+		t.Fatalf("got err '%v' after breaker closed", err)
+	}
+}
+
+/* A burst of key IDs that nodeman refuses must not lock out other senders */
+func TestGetKeyClientErrorsKeepBreakerClosed(t *testing.T) {
+	for _, code := range []int32{http.StatusNotFound, http.StatusGone, http.StatusBadRequest, http.StatusUnprocessableEntity} {
+		t.Run(http.StatusText(int(code)), func(t *testing.T) {
+			var status, requests atomic.Int32
+			status.Store(code)
+			client := setup(t, &status, &requests)
+
+			for _, keyID := range []string{"a", "b", "c", "d", "e"} {
+				_, err := client.GetKey(keyID)
+				if !errors.Is(err, shared.ErrNodemanKeyNotFound) {
+					t.Fatalf("got err '%v' for key '%s'", err, keyID)
+				}
+			}
+
+			status.Store(http.StatusOK)
+			_, err := client.GetKey("legitimate")
+			if err != nil {
+				t.Fatalf("got err '%v', expected breaker to be closed", err)
+			}
+
+			if requests.Load() != 6 {
+				t.Fatalf("expected 6 requests, got %d", requests.Load())
+			}
+		})
+	}
+}
+
+func TestGetKeyServerErrorsTripBreaker(t *testing.T) {
+	for _, code := range []int32{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(int(code)), func(t *testing.T) {
+			var status, requests atomic.Int32
+			status.Store(code)
+			client := setup(t, &status, &requests)
+
+			for _, keyID := range []string{"a", "b", "c", "d", "e"} {
+				_, err := client.GetKey(keyID)
+				if err == nil || errors.Is(err, shared.ErrNodemanKeyNotFound) {
+					t.Fatalf("got err '%v' for key '%s', expected failure", err, keyID)
+				}
+			}
+
+			/* Backed off per key and breaker open after the limit */
+			_, err := client.GetKey("a")
+			if !errors.Is(err, shared.ErrNodemanUnavailable) {
+				t.Fatalf("got err '%v', expected backoff", err)
+			}
+
+			if requests.Load() != 3 {
+				t.Fatalf("expected 3 requests, got %d", requests.Load())
+			}
+		})
+	}
+}
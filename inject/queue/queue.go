@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/dnstapir/mqtt-bridge/shared"
+)
+
+/* Warn about every n:th dropped message to avoid flooding the log */
+const cDROP_LOG_INTERVAL = 1000
+
+type Queue[T any] struct {
+	log     shared.LoggerIF
+	name    string
+	policy  shared.OverflowPolicy
+	ch      chan T
+	done    <-chan struct{}
+	closing chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+/*
+ * Create a bounded queue. Pushing never blocks past the closing of the done
+ * channel or of the queue itself.
+ */
+func New[T any](log shared.LoggerIF, name string, conf shared.QueueConf, done <-chan struct{}) *Queue[T] {
+	newQueue := new(Queue[T])
+
+	size := conf.Size
+	if size == 0 {
+		size = shared.QUEUE_DEFAULT_SIZE
+	}
+
+	policy := conf.Overflow
+	if policy == "" {
+		policy = shared.OVERFLOW_BLOCK
+	}
+
+	newQueue.log = log
+	newQueue.name = name
+	newQueue.policy = policy
+	newQueue.ch = make(chan T, size)
+	newQueue.done = done
+	newQueue.closing = make(chan struct{})
+
+	return newQueue
+}
+
+func (q *Queue[T]) C() <-chan T {
+	return q.ch
+}
+
+func (q *Queue[T]) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+/* Returns false if an item, new or old, had to be dropped */
+func (q *Queue[T]) Push(item T) bool {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+
+	if q.closed {
+		q.drop("queue closed")
+		return false
+	}
+
+	switch q.policy {
+	case shared.OVERFLOW_DROP_NEWEST:
+		select {
+		case q.ch <- item:
+			return true
+		default:
+			q.drop("queue full, dropping newest")
+			return false
+		}
+	case shared.OVERFLOW_DROP_OLDEST:
+		ok := true
+		for {
+			select {
+			case q.ch <- item:
+				return ok
+			default:
+			}
+
+			select {
+			case <-q.ch:
+				q.drop("queue full, dropping oldest")
+				ok = false
+			default:
+			}
+		}
+	default:
+		select {
+		case q.ch <- item:
+			return true
+		case <-q.done:
+			q.drop("shutdown signaled")
+			return false
+		case <-q.closing:
+			q.drop("queue closing")
+			return false
+		}
+	}
+}
+
+/* Unblocks pending pushes first, so a single queue can be closed at any time */
+func (q *Queue[T]) Close() {
+	q.once.Do(func() {
+		close(q.closing)
+	})
+
+	q.closeMu.Lock()
+	defer q.closeMu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+func (q *Queue[T]) drop(reason string) {
+	n := q.dropped.Add(1)
+
+	if n == 1 || n%cDROP_LOG_INTERVAL == 0 {
+		q.log.Warning("Dropped message on '%s' (%s), %d dropped in total", q.name, reason, n)
+	} else {
+		q.log.Debug("Dropped message on '%s' (%s), %d dropped in total", q.name, reason, n)
+	}
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dnstapir/mqtt-bridge/inject/fake"
+	"github.com/dnstapir/mqtt-bridge/shared"
+)
+
+func TestQueueOverflow(t *testing.T) {
+	var tests = []struct {
+		name            string
+		policy          shared.OverflowPolicy
+		expectedItems   []int
+		expectedDropped uint64
+	}{
+		{"DROP_NEWEST", shared.OVERFLOW_DROP_NEWEST, []int{0, 1}, 2},
+		{"DROP_OLDEST", shared.OVERFLOW_DROP_OLDEST, []int{2, 3}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			conf := shared.QueueConf{Size: 2, Overflow: tt.policy}
+			q := New[int](fake.Logger(), "test", conf, done)
+
+			for i := range 4 {
+				q.Push(i)
+			}
+
+			q.Close()
+
+			got := make([]int, 0)
+			for i := range q.C() {
+				got = append(got, i)
+			}
+
+			if len(got) != len(tt.expectedItems) {
+				t.Fatalf("got %v, expected %v", got, tt.expectedItems)
+			}
+			for i := range got {
+				if got[i] != tt.expectedItems[i] {
+					t.Fatalf("got %v, expected %v", got, tt.expectedItems)
+				}
+			}
+
+			if q.Dropped() != tt.expectedDropped {
+				t.Fatalf("got %d dropped, expected %d", q.Dropped(), tt.expectedDropped)
+			}
+		})
+	}
+}
+
+func TestQueueBlockUnblocksOnDone(t *testing.T) {
+	done := make(chan struct{})
+	conf := shared.QueueConf{Size: 1, Overflow: shared.OVERFLOW_BLOCK}
+	q := New[int](fake.Logger(), "test", conf, done)
+
+	if !q.Push(0) {
+		t.Fatalf("first push should succeed")
+	}
+
+	result := make(chan bool)
+	go func() {
+		result <- q.Push(1)
+	}()
+
+	close(done)
+
+	if <-result {
+		t.Fatalf("push should fail after done")
+	}
+
+	q.Close()
+
+	if q.Push(2) {
+		t.Fatalf("push should fail after close")
+	}
+
+	if q.Dropped() != 2 {
+		t.Fatalf("got %d dropped, expected 2", q.Dropped())
+	}
+}
+
+func TestQueueBlockUnblocksOnClose(t *testing.T) {
+	done := make(chan struct{})
+	conf := shared.QueueConf{Size: 1, Overflow: shared.OVERFLOW_BLOCK}
+	q := New[int](fake.Logger(), "test", conf, done)
+
+	if !q.Push(0) {
+		t.Fatalf("first push should succeed")
+	}
+
+	result := make(chan bool)
+	go func() {
+		result <- q.Push(1)
+	}()
+
+	/* Close must not wait for the blocked push */
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+
+	if <-result {
+		t.Fatalf("push should fail after close")
+	}
+
+	if q.Dropped() != 1 {
+		t.Fatalf("got %d dropped, expected 1", q.Dropped())
+	}
+}
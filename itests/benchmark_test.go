@@ -3,11 +3,18 @@
 package itests
 
 import (
+    "encoding/json"
     "fmt"
+    "path/filepath"
     "sync"
 	"testing"
+    "time"
 
 	"github.com/dnstapir/mqtt-bridge/app/keys"
+	"github.com/dnstapir/mqtt-bridge/app/templates"
+	"github.com/dnstapir/mqtt-bridge/app/topics"
+	"github.com/dnstapir/mqtt-bridge/app/upbridge"
+	"github.com/dnstapir/mqtt-bridge/inject/logging"
     "github.com/dnstapir/mqtt-bridge/shared"
 )
 
@@ -24,7 +31,7 @@ func BenchmarkDownBasic(b *testing.B) {
         panic(err)
     }
 
-    outCh, err := it.mqttClient.Subscribe("observations/down/tapir-pop")
+    outCh, err := it.mqttClient.Subscribe("observations/down/tapir-pop", 0, shared.QueueConf{})
     if err != nil {
         panic(err)
     }
@@ -82,12 +89,12 @@ func BenchmarkUpBasicWithoutSchema(b *testing.B) {
         preparedData[i] = signedIndata
     }
 
-    inChMqtt, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false)
+    inChMqtt, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false, 0)
     if err != nil {
         panic(err)
     }
 
-    outChNats, err := it.natsClient.Subscribe("events.up.some_event", "eventQ")
+    outChNats, err := it.natsClient.Subscribe("events.up.some_event", "eventQ", shared.QueueConf{})
     if err != nil {
         panic(err)
     }
@@ -109,7 +116,7 @@ func BenchmarkUpBasicWithoutSchema(b *testing.B) {
     }()
 
     for _, d := range preparedData {
-        inChMqtt <- d
+        inChMqtt <- shared.MqttData{Payload: d}
     }
 
     wg.Wait()
@@ -122,3 +129,102 @@ func BenchmarkUpBasicWithoutSchema(b *testing.B) {
         it.Fatalf("Sent %d messages but only received %d", n_MESSAGES, count)
     }
 }
+
+type benchNodeman struct {
+    keys map[string][]byte
+}
+
+func (n *benchNodeman) GetKey(keyID string) ([]byte, error) {
+    time.Sleep(10*time.Millisecond) /* simulate slow nodeman */
+    return n.keys[keyID], nil
+}
+
+/*
+ * Runs the up bridge in-process, without any containers, to compare
+ * throughput for different numbers of verification workers. Messages are
+ * spread over several senders so that they can be sharded between workers.
+ */
+func BenchmarkUpbridgeWorkers(b *testing.B) {
+    n_SENDERS := 16
+    n_MESSAGES := 20000
+
+    log := logging.Create(false, true)
+    keys.SetLogger(log)
+
+    nodeman := &benchNodeman{keys: make(map[string][]byte)}
+    preparedData := make([]shared.MqttData, n_MESSAGES)
+    signkeys := make([]keys.SignKey, n_SENDERS)
+    for i := range n_SENDERS {
+        kid := fmt.Sprintf("bench-key-%d", i)
+        key, err := keys.GenerateSignKey(filepath.Join(b.TempDir(), kid + ".json"), kid)
+        if err != nil {
+            panic(err)
+        }
+        signkeys[i] = key
+
+        valkey, err := keys.ToValkey(key)
+        if err != nil {
+            panic(err)
+        }
+        valkeyBytes, err := json.Marshal(valkey)
+        if err != nil {
+            panic(err)
+        }
+        nodeman.keys[kid] = valkeyBytes
+    }
+
+    for i := range n_MESSAGES {
+        key := signkeys[i%n_SENDERS]
+        signedIndata, err := keys.Sign([]byte(fmt.Sprintf(msgTmpl, i)), key)
+        if err != nil {
+            panic(err)
+        }
+        preparedData[i] = shared.MqttData{
+            Topic: "events/up/" + key.KeyID(),
+            Payload: signedIndata,
+        }
+    }
+
+    for _, workers := range []int{1, 2, 4, 8} {
+        b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+            topic, err := topics.ParsePattern("events/up/{kid}")
+            if err != nil {
+                panic(err)
+            }
+            subject, err := templates.ForNatsSubject("events.up.{kid}")
+            if err != nil {
+                panic(err)
+            }
+
+            for range b.N {
+                conf := upbridge.Conf{
+                    Log: log,
+                    Nodeman: nodeman,
+                    Topic: topic,
+                    Subject: subject,
+                    Workers: workers,
+                }
+                ub, err := upbridge.Create(conf)
+                if err != nil {
+                    panic(err)
+                }
+
+                inCh := make(chan shared.MqttData, n_MESSAGES)
+                outCh := make(chan shared.NatsData, n_MESSAGES)
+                for _, d := range preparedData {
+                    inCh <- d
+                }
+
+                start := time.Now()
+                go ub.Start(inCh, outCh)
+                for range n_MESSAGES {
+                    <-outCh
+                }
+                elapsed := time.Since(start)
+                ub.Stop()
+
+                b.ReportMetric(float64(n_MESSAGES)/elapsed.Seconds(), "msgs/s")
+            }
+        })
+    }
+}
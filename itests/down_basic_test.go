@@ -21,7 +21,7 @@ func TestIntegrationDownBasic(t *testing.T) {
         panic(err)
     }
 
-    outCh, err := it.mqttClient.Subscribe("observations/down/tapir-pop")
+    outCh, err := it.mqttClient.Subscribe("observations/down/tapir-pop", 0, shared.QueueConf{})
     if err != nil {
         panic(err)
     }
@@ -21,7 +21,7 @@ func TestIntegrationDownDisconnect(t *testing.T) {
         panic(err)
     }
 
-    outChMqtt, err := it.mqttClient.Subscribe("observations/down/tapir-pop")
+    outChMqtt, err := it.mqttClient.Subscribe("observations/down/tapir-pop", 0, shared.QueueConf{})
     if err != nil {
         panic(err)
     }
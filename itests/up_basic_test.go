@@ -7,6 +7,7 @@ import (
     "testing"
 
 	"github.com/dnstapir/mqtt-bridge/app/keys"
+    "github.com/dnstapir/mqtt-bridge/shared"
 )
 
 func TestIntegrationUpBasicWithoutSchema(t *testing.T) {
@@ -15,12 +16,12 @@ func TestIntegrationUpBasicWithoutSchema(t *testing.T) {
     it.setup(true)
     defer it.teardown()
 
-    inCh, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false)
+    inCh, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false, 0)
     if err != nil {
         panic(err)
     }
 
-    outCh, err := it.natsClient.Subscribe("events.up.some_event", "eventQ")
+    outCh, err := it.natsClient.Subscribe("events.up.some_event", "eventQ", shared.QueueConf{})
     if err != nil {
         panic(err)
     }
@@ -31,12 +32,12 @@ func TestIntegrationUpBasicWithoutSchema(t *testing.T) {
         panic(err)
     }
 
-    inCh <- signedIndata
+    inCh <- shared.MqttData{Payload: signedIndata}
 
     got := <-outCh
 
     wanted := indata
-    if !bytes.Equal(wanted, got) {
-        t.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got))
+    if !bytes.Equal(wanted, got.Payload) {
+        t.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got.Payload))
     }
 }
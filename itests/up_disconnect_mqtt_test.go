@@ -7,6 +7,7 @@ import (
     "testing"
 
 	"github.com/dnstapir/mqtt-bridge/app/keys"
+    "github.com/dnstapir/mqtt-bridge/shared"
 )
 
 func TestIntegrationUpBasicWithoutSchemaDisconnectMqtt(t *testing.T) {
@@ -16,12 +17,12 @@ func TestIntegrationUpBasicWithoutSchemaDisconnectMqtt(t *testing.T) {
     it.setup(true)
     defer it.teardown()
 
-    inChMqtt, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false)
+    inChMqtt, err := it.mqttClient.StartPublishing("events/up/" + it.signkey.KeyID(), false, 0)
     if err != nil {
         panic(err)
     }
 
-    outChNats, err := it.natsClient.Subscribe("events.up.some_event", "eventQ")
+    outChNats, err := it.natsClient.Subscribe("events.up.some_event", "eventQ", shared.QueueConf{})
     if err != nil {
         panic(err)
     }
@@ -32,18 +33,18 @@ func TestIntegrationUpBasicWithoutSchemaDisconnectMqtt(t *testing.T) {
         panic(err)
     }
 
-    go func(){inChMqtt <- signedIndata}()
+    go func(){inChMqtt <- shared.MqttData{Payload: signedIndata}}()
 
     got := <-outChNats
 
     wanted := indata
-    if !bytes.Equal(wanted, got) {
-        it.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got))
+    if !bytes.Equal(wanted, got.Payload) {
+        it.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got.Payload))
     }
 
     it.restartService("mosquitto")
 
-    go func(){inChMqtt <- signedIndata}()
+    go func(){inChMqtt <- shared.MqttData{Payload: signedIndata}}()
 
     it.Logf("Waiting for response data...")
 
@@ -52,7 +53,7 @@ func TestIntegrationUpBasicWithoutSchemaDisconnectMqtt(t *testing.T) {
     it.Logf("Got it!")
 
     wanted = indata
-    if !bytes.Equal(wanted, got) {
-        it.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got))
+    if !bytes.Equal(wanted, got.Payload) {
+        it.Fatalf("wanted: '%s', got: '%s'", string(wanted), string(got.Payload))
     }
 }
@@ -1,6 +1,8 @@
 package setup
 
 import (
+	"time"
+
 	"github.com/dnstapir/mqtt-bridge/app"
 	"github.com/dnstapir/mqtt-bridge/inject/logging"
 	"github.com/dnstapir/mqtt-bridge/inject/mqtt"
@@ -9,15 +11,21 @@ import (
 )
 
 type AppConf struct {
-	Debug          bool         `toml:"Debug"`
-	Quiet          bool         `toml:"Quiet"`
-	MqttUrl        string       `toml:"MqttUrl"`
-	MqttCaCert     string       `toml:"MqttCaCert"`
-	MqttClientCert string       `toml:"MqttClientCert"`
-	MqttClientKey  string       `toml:"MqttClientKey"`
-	NatsUrl        string       `toml:"NatsUrl"`
-	NodemanApiUrl  string       `toml:"NodemanApiUrl"`
-	Bridges        []app.Bridge `toml:"Bridges"`
+	Debug              bool         `toml:"Debug"`
+	Quiet              bool         `toml:"Quiet"`
+	MqttUrl            string       `toml:"MqttUrl"`
+	MqttCaCert         string       `toml:"MqttCaCert"`
+	MqttClientCert     string       `toml:"MqttClientCert"`
+	MqttClientKey      string       `toml:"MqttClientKey"`
+	MqttClientId       string       `toml:"MqttClientId"`
+	MqttKeepAlive      *uint16      `toml:"MqttKeepAlive"`
+	MqttSessionExpiry  *uint32      `toml:"MqttSessionExpiry"`
+	MqttCleanStart     bool         `toml:"MqttCleanStart"`
+	MqttReceiveMaximum uint16       `toml:"MqttReceiveMaximum"`
+	MqttConnectTimeout int          `toml:"MqttConnectTimeout"`
+	NatsUrl            string       `toml:"NatsUrl"`
+	NodemanApiUrl      string       `toml:"NodemanApiUrl"`
+	Bridges            []app.Bridge `toml:"Bridges"`
 }
 
 func BuildApp(conf AppConf) (*app.App, error) {
@@ -29,6 +37,12 @@ func BuildApp(conf AppConf) (*app.App, error) {
 		MqttCaCert:     conf.MqttCaCert,
 		MqttClientCert: conf.MqttClientCert,
 		MqttClientKey:  conf.MqttClientKey,
+		ClientId:       conf.MqttClientId,
+		KeepAlive:      conf.MqttKeepAlive,
+		SessionExpiry:  conf.MqttSessionExpiry,
+		CleanStart:     conf.MqttCleanStart,
+		ReceiveMaximum: conf.MqttReceiveMaximum,
+		ConnectTimeout: time.Duration(conf.MqttConnectTimeout) * time.Second,
 	}
 	mqttClient, err := mqtt.Create(mqttConf)
 	if err != nil {
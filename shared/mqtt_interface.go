@@ -2,13 +2,15 @@ package shared
 
 type MqttIF interface {
 	Connect() error
-	Subscribe(string) (<-chan MqttData, error)
-	StartPublishing(string, bool) (chan<- []byte, error)
+	Subscribe(string, byte, QueueConf) (<-chan MqttData, error)
+	Unsubscribe(<-chan MqttData) error
+	StartPublishing(string, bool, byte) (chan<- MqttData, error)
 	CheckConnection() bool
 	Stop()
 }
 
 type MqttData struct {
-	Topic   string
+	Topic   string // Overrides the publishing topic if set
 	Payload []byte
+	Done    func(error) // Called with the result of publishing, if set
 }
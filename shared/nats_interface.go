@@ -1,25 +1,71 @@
 package shared
 
+import (
+	"strings"
+	"time"
+)
+
 const NATSHEADER_DNSTAPIR_MESSAGE_SCHEMA = "DNSTAPIR-Message-Schema"
 const NATSHEADER_DNSTAPIR_MQTT_TOPIC = "DNSTAPIR-Mqtt-Topic"
 const NATSHEADER_DNSTAPIR_KEY_IDENTIFIER = "DNSTAPIR-Key-Identifier"
 const NATSHEADER_DNSTAPIR_KEY_THUMBPRINT = "DNSTAPIR-Key-Thumbprint"
+const NATSHEADER_DNSTAPIR_VERIFIED_KEY_IDENTIFIERS = "DNSTAPIR-Verified-Key-Identifiers"
+const NATSHEADER_DNSTAPIR_VERIFIED_KEY_THUMBPRINTS = "DNSTAPIR-Verified-Key-Thumbprints"
+const NATSHEADER_DNSTAPIR_NATS_SUBJECT = "DNSTAPIR-Nats-Subject"
+const NATSHEADER_DNSTAPIR_REJECT_REASON = "DNSTAPIR-Reject-Reason"
+const NATSHEADER_DNSTAPIR_REJECT_ERROR = "DNSTAPIR-Reject-Error"
 
 var NATSHEADERS_DNSTAPIR_ALL = []string{
 	NATSHEADER_DNSTAPIR_MESSAGE_SCHEMA,
 	NATSHEADER_DNSTAPIR_MQTT_TOPIC,
 	NATSHEADER_DNSTAPIR_KEY_IDENTIFIER,
 	NATSHEADER_DNSTAPIR_KEY_THUMBPRINT,
+	NATSHEADER_DNSTAPIR_VERIFIED_KEY_IDENTIFIERS,
+	NATSHEADER_DNSTAPIR_VERIFIED_KEY_THUMBPRINTS,
+	NATSHEADER_DNSTAPIR_NATS_SUBJECT,
+	NATSHEADER_DNSTAPIR_REJECT_REASON,
+	NATSHEADER_DNSTAPIR_REJECT_ERROR,
 }
 
+/* Values of the reject reason header on dead-lettered messages */
+const REJECT_REASON_MALFORMED_JWS = "malformed-jws"
+const REJECT_REASON_TOPIC_MISMATCH = "topic-mismatch"
+const REJECT_REASON_KEY_LOOKUP = "key-lookup"
+const REJECT_REASON_BAD_SIGNATURE = "bad-signature"
+const REJECT_REASON_SIGNING = "signing"
+const REJECT_REASON_SCHEMA = "schema"
+const REJECT_REASON_TEMPLATE = "template"
+const REJECT_REASON_STALE = "stale"
+const REJECT_REASON_REPLAY = "replay"
+
 type NatsIF interface {
 	Connect() error
-	Subscribe(string, string) (<-chan []byte, error)
+	Subscribe(string, string, QueueConf) (<-chan NatsData, error)
+	SubscribeDurable(string, string, string, QueueConf) (<-chan NatsData, error)
+	Unsubscribe(<-chan NatsData) error
 	StartPublishing(string, string) (chan<- NatsData, error)
+	StartJetStreamPublishing(string, <-chan struct{}) (chan<- NatsData, error)
 	Stop()
 }
 
 type NatsData struct {
+	Subject string // Overrides the publishing subject if set
+	Reply   string
+	MsgID   string // Used for deduplication when publishing to JetStream
 	Headers map[string]string
 	Payload []byte
+	Acker   NatsAcker // Set for messages from durable consumers only
+}
+
+type NatsAcker interface {
+	Ack() error
+	NakWithDelay(time.Duration) error
+	Term() error
+}
+
+var headerValueReplacer = strings.NewReplacer("\r", "", "\n", " ")
+
+/* NATS header values must not span multiple lines */
+func HeaderValue(val string) string {
+	return headerValueReplacer.Replace(val)
 }
@@ -1,5 +1,16 @@
 package shared
 
+import "errors"
+
+/*
+ * Nodeman answered but does not know the key, or refused the key ID, worth
+ * remembering for a while
+ */
+var ErrNodemanKeyNotFound = errors.New("key not found in nodeman")
+
+/* Nodeman was not asked, either backing off or considered unhealthy */
+var ErrNodemanUnavailable = errors.New("nodeman unavailable")
+
 type NodemanIF interface {
 	GetKey(string) ([]byte, error)
 }
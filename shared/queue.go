@@ -0,0 +1,28 @@
+package shared
+
+type OverflowPolicy string
+
+const OVERFLOW_BLOCK OverflowPolicy = "block"
+const OVERFLOW_DROP_NEWEST OverflowPolicy = "drop-newest"
+const OVERFLOW_DROP_OLDEST OverflowPolicy = "drop-oldest"
+
+const QUEUE_DEFAULT_SIZE = 1024
+
+/* Bounds the queue between a receiving client and a bridge */
+type QueueConf struct {
+	Size     int
+	Overflow OverflowPolicy
+}
+
+func (q QueueConf) IsValid() bool {
+	if q.Size < 0 {
+		return false
+	}
+
+	switch q.Overflow {
+	case "", OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST:
+		return true
+	}
+
+	return false
+}